@@ -0,0 +1,90 @@
+//main applies or rolls back Postgres schema migrations of shortener service.
+//Usage: migrate [-d dsn] [-version N] up|down|status
+//  up     - applies migrations up to version N (default: latest), never rolls back
+//  down   - rolls back migrations down to version N (default: one step back), never applies
+//  status - prints current and latest schema versions
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/antonevtu/go_shortener_adv/internal/db"
+	"log"
+	"os"
+)
+
+func main() {
+	dsn := flag.String("d", os.Getenv("DATABASE_DSN"), "postgres url")
+	version := flag.Int("version", -1, "target schema version")
+	flag.Parse()
+	if *dsn == "" {
+		log.Fatal("database DSN is not set (DATABASE_DSN or -d)")
+	}
+
+	ctx := context.Background()
+	dbPool, err := db.Connect(ctx, *dsn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer dbPool.Close()
+
+	current, err := dbPool.SchemaVersion(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	latest, err := db.LatestVersion()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	target := *version
+	switch flag.Arg(0) {
+	case "up":
+		if target < 0 {
+			target = latest
+		}
+		if target < current {
+			log.Fatalf("schema version %d is above %d, run down -version %d to roll back\n", current, target, target)
+		}
+	case "down":
+		if target < 0 {
+			target, err = previousVersion(current)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		if target > current {
+			log.Fatalf("schema version %d is below %d, run up -version %d to upgrade\n", current, target, target)
+		}
+	case "status":
+		log.Printf("schema version %d, latest %d\n", current, latest)
+		return
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err = dbPool.MigrateTo(ctx, target); err != nil {
+		log.Fatal(err)
+	}
+	current, err = dbPool.SchemaVersion(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("schema version %d, latest %d\n", current, latest)
+}
+
+//previousVersion returns version of migration before current one, 0 if there is no such migration
+func previousVersion(current int) (int, error) {
+	migrations, err := db.Migrations()
+	if err != nil {
+		return 0, err
+	}
+	previous := 0
+	for _, m := range migrations {
+		if m.Version < current {
+			previous = m.Version
+		}
+	}
+	return previous, nil
+}
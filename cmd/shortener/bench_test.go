@@ -10,6 +10,8 @@ import (
 	"github.com/antonevtu/go_shortener_adv/internal/cfg"
 	"github.com/antonevtu/go_shortener_adv/internal/db"
 	"github.com/antonevtu/go_shortener_adv/internal/handlers"
+	"github.com/antonevtu/go_shortener_adv/internal/pool"
+	"github.com/antonevtu/go_shortener_adv/internal/repository"
 	"github.com/docker/go-connections/nat"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v4/pgxpool"
@@ -21,6 +23,8 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 )
@@ -132,6 +136,134 @@ func BenchmarkOne(b *testing.B) {
 	})
 }
 
+// BenchmarkFileMixed нагружает файловое хранилище смешанными запросами из параллельных горутин:
+// каждый десятый запрос сокращает URL, остальные запрашивают редиректы.
+// Хранилище вызывается напрямую, чтобы логирование и роутер не сериализовали запросы.
+// whole_lock - прежний путь чтения: одна блокировка на всё хранилище, редиректы ждут записи в файл
+func BenchmarkFileMixed(b *testing.B) {
+	for _, policy := range []repository.SyncPolicy{repository.SyncNever, repository.SyncAlways} {
+		b.Run(string(policy), func(b *testing.B) {
+			b.Run("whole_lock", func(b *testing.B) {
+				repo := newFileRepo(b, policy)
+				defer repo.Close()
+				benchMixed(b, &wholeLockRepo{Repository: repo})
+			})
+			b.Run("read_lock", func(b *testing.B) {
+				repo := newFileRepo(b, policy)
+				defer repo.Close()
+				benchMixed(b, repo)
+			})
+		})
+	}
+}
+
+// wholeLockRepo держит одну блокировку на весь вызов, включая запись в файл, как хранилище
+// до разделения блокировок. Блокировки самого хранилища под ней не конкурируют
+type wholeLockRepo struct {
+	*repository.Repository
+	lock sync.Mutex
+}
+
+func (w *wholeLockRepo) AddOrGetEntity(ctx context.Context, entity db.Entity) (db.Entity, bool, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.Repository.AddOrGetEntity(ctx, entity)
+}
+
+func (w *wholeLockRepo) SelectByShortID(ctx context.Context, shortID string) (db.Entity, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.Repository.SelectByShortID(ctx, shortID)
+}
+
+func newFileRepo(b *testing.B, policy repository.SyncPolicy) *repository.Repository {
+	repo, err := repository.New(filepath.Join(b.TempDir(), "storage.txt"), repository.WithSync(policy, 0))
+	if err != nil {
+		panic(err)
+	}
+	return repo
+}
+
+func benchMixed(b *testing.B, repo handlers.Repositorier) {
+	ctx := context.Background()
+
+	// заполнение хранилища
+	shortIDs := make([]string, 1000)
+	for i := range shortIDs {
+		shortIDs[i] = uuid.NewString()[:8]
+		_, _, err := repo.AddOrGetEntity(ctx, db.Entity{UserID: "u", ShortID: shortIDs[i], LongURL: "https://yandex.ru/" + shortIDs[i]})
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			if i%10 == 0 {
+				shortID := uuid.NewString()
+				_, _, err := repo.AddOrGetEntity(ctx, db.Entity{UserID: "u", ShortID: shortID, LongURL: "https://yandex.ru/" + shortID})
+				if err != nil {
+					panic(err)
+				}
+				continue
+			}
+			if _, err := repo.SelectByShortID(ctx, shortIDs[rand.Intn(len(shortIDs))]); err != nil {
+				panic(err)
+			}
+		}
+	})
+}
+
+// BenchmarkSetDeleted сравнивает удаление 1000 ссылок по одной записи и одним запросом в Postgres
+func BenchmarkSetDeleted(b *testing.B) {
+	container, database := createDBConnection()
+	defer container.Terminate(context.Background())
+	defer database.Close()
+	migrations(database)
+	ctx := context.Background()
+
+	// добавление ссылок пользователя, возвращает их ID
+	seed := func(userID string) []string {
+		input := make(db.BatchInput, 1000)
+		shortIDs := make([]string, len(input))
+		for i := range input {
+			input[i] = db.BatchInputItem{OriginalURL: "https://yandex.ru/" + uuid.NewString(), ShortID: uuid.NewString()}
+			shortIDs[i] = input[i].ShortID
+		}
+		if err := database.AddEntityBatch(ctx, userID, input); err != nil {
+			panic(err)
+		}
+		return shortIDs
+	}
+
+	b.Run("loop", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			userID := uuid.NewString()
+			shortIDs := seed(userID)
+			b.StartTimer()
+			for _, shortID := range shortIDs {
+				if err := database.SetDeleted(ctx, pool.ToDeleteItem{UserID: userID, ShortID: shortID}); err != nil {
+					panic(err)
+				}
+			}
+		}
+	})
+
+	b.Run("set", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			userID := uuid.NewString()
+			shortIDs := seed(userID)
+			b.StartTimer()
+			if _, err := database.SetDeletedBatch(ctx, userID, shortIDs); err != nil {
+				panic(err)
+			}
+		}
+	})
+}
+
 func newConfig() cfg.Config {
 	cfgApp := cfg.Config{
 		ServerAddress:   *ServerAddress,
@@ -202,13 +334,7 @@ func createTestContainer(ctx context.Context, dbname string) (testcontainers.Con
 
 func migrations(dbPool db.T) {
 	// создание таблицы
-	sql1 := "create table if not exists urls (" +
-		"id serial primary key, " +
-		"deleted boolean not null," +
-		"user_id varchar(512) not null, " +
-		"short_id varchar(512) not null unique, " +
-		"long_url varchar(1024) not null unique)"
-	_, err := dbPool.Exec(context.Background(), sql1)
+	err := dbPool.MigrateUp(context.Background())
 	if err != nil {
 		panic(err)
 	}
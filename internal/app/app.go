@@ -2,11 +2,12 @@ package app
 
 import (
 	"context"
+	"github.com/antonevtu/go_shortener_adv/internal/backend"
 	"github.com/antonevtu/go_shortener_adv/internal/cfg"
-	"github.com/antonevtu/go_shortener_adv/internal/db"
+	"github.com/antonevtu/go_shortener_adv/internal/clicks"
 	"github.com/antonevtu/go_shortener_adv/internal/handlers"
 	"github.com/antonevtu/go_shortener_adv/internal/pool"
-	"github.com/antonevtu/go_shortener_adv/internal/repository"
+	"github.com/antonevtu/go_shortener_adv/internal/reaper"
 	"log"
 	"net"
 	"net/http"
@@ -27,30 +28,53 @@ func Run() {
 	defer cancel()
 
 	// select repository
-	var repo handlers.Repositorier
-	if cfgApp.DatabaseDSN != "" {
-		// postgres
-		dbPool, err := db.New(ctx, cfgApp.DatabaseDSN)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer dbPool.Close()
-		repo = &dbPool
-		log.Println("DB connected!")
+	repo, err := backend.Open(ctx, cfgApp)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer repo.Close()
+	if from := backend.InferredFrom(cfgApp); from != "" {
+		log.Printf("storage backend: %s, inferred from %s; set STORAGE_BACKEND or -s to select it explicitly\n", backend.Name(cfgApp), from)
 	} else {
-		// file&map repository
-		fileRepo, err := repository.New(cfgApp.FileStoragePath)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer fileRepo.Close()
-		repo = fileRepo
+		log.Printf("storage backend: %s\n", backend.Name(cfgApp))
 	}
 
 	// repository pool for delete items (set flag "deleted")
-	deleterPool := pool.New(ctx, repo)
+	// accepted deletions are journaled in repository and resumed after restart
+	poolOpts := []pool.Option{
+		pool.WithWorkers(cfgApp.DeleteWorkers),
+		pool.WithQueueSize(cfgApp.DeleteQueueSize),
+		pool.WithBatching(cfgApp.DeleteBatchSize, cfgApp.DeleteLatency),
+		pool.WithRetry(cfgApp.DeleteRetries, cfgApp.DeleteRetryBase, cfgApp.DeleteRetryMax),
+		pool.WithDeadLetters(cfgApp.DeadLetters),
+		pool.WithJobRetention(cfgApp.DeleteJobs),
+		pool.WithOwnerLookup(backend.OwnerLookup(repo)),
+	}
+	if journal, ok := repo.(pool.Journal); ok {
+		poolOpts = append(poolOpts, pool.WithJournal(journal))
+	}
+	deleterPool := pool.New(ctx, repo, poolOpts...)
 	defer deleterPool.Close()
-	cfgApp.DeleterChan = deleterPool.Input
+	cfgApp.DeleterPool = &deleterPool
+
+	// soft-deleting of expired links, repository is closed only after reaper has stopped
+	reaperDone := reaper.Run(ctx, repo, cfgApp.ReapInterval)
+	defer func() { <-reaperDone }()
+
+	// asynchronous writing of redirects for link statistics
+	if store, ok := repo.(clicks.Store); ok {
+		clickWriter := clicks.New(ctx, store,
+			clicks.WithBuffer(cfgApp.ClickBuffer),
+			clicks.WithBatching(cfgApp.ClickBatchSize, cfgApp.ClickFlush))
+		defer clickWriter.Close()
+		cfgApp.ClickWriter = &clickWriter
+	}
+
+	// raw clicks are purged after retention, their rollups are kept
+	if purger, ok := repo.(clicks.Purger); ok {
+		retentionDone := clicks.RunRetention(ctx, purger, cfgApp.ClickRetention, cfgApp.ClickPurge)
+		defer func() { <-retentionDone }()
+	}
 
 	//r := handlers.NewRouter(repo, cfgApp)
 	r := handlers.NewRouter(repo, cfgApp)
@@ -76,12 +100,8 @@ func Run() {
 		syscall.SIGQUIT, // kill -SIGQUIT XXXX
 	)
 
-	select {
-	case <-signalChan:
-		log.Println("os.Interrupt - shutting down...")
-	case err := <-deleterPool.ErrCh:
-		log.Println(err)
-	}
+	<-signalChan
+	log.Println("os.Interrupt - shutting down...")
 	cancel()
 
 	gracefulCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
@@ -0,0 +1,82 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type aliasBatchItem struct {
+	CorrelationID string `json:"correlation_id"`
+	OriginalURL   string `json:"original_url"`
+	Alias         string `json:"alias,omitempty"`
+}
+
+func TestAlias(t *testing.T) {
+	for _, name := range testBackends {
+		t.Run(name, func(t *testing.T) {
+			_, repo, ts := newTestServer(t, name, nil)
+			defer repo.Close()
+
+			shorten := func(longURL, alias string) (*http.Response, string) {
+				buf, err := json.Marshal(map[string]string{"url": longURL, "alias": alias})
+				require.NoError(t, err)
+				return testRequest(t, ts.URL+"/api/shorten", http.MethodPost, bytes.NewBuffer(buf))
+			}
+
+			// псевдоним вместо сгенерированного ID
+			resp, body := shorten("https://yandex.ru/sale", "spring-sale")
+			require.Equal(t, http.StatusCreated, resp.StatusCode)
+			require.JSONEq(t, `{"result":"`+*BaseURL+`/spring-sale"}`, body)
+			resp, _ = testRequest(t, ts.URL+"/spring-sale", http.MethodGet, nil)
+			require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+			require.Equal(t, "https://yandex.ru/sale", resp.Header.Get("Location"))
+
+			// псевдоним занят другим URL
+			resp, body = shorten("https://yandex.ru/other", "spring-sale")
+			require.Equal(t, http.StatusConflict, resp.StatusCode)
+			require.Contains(t, body, "already taken")
+
+			// повтор того же URL возвращает существующий короткий URL
+			resp, body = shorten("https://yandex.ru/sale", "autumn-sale")
+			require.Equal(t, http.StatusConflict, resp.StatusCode)
+			require.JSONEq(t, `{"result":"`+*BaseURL+`/spring-sale"}`, body)
+
+			// недопустимые псевдонимы
+			for _, alias := range []string{"api", "Ping", "debug", "a/b", "ab", "sale!", strings.Repeat("x", 65)} {
+				resp, _ = shorten("https://yandex.ru/bad", alias)
+				require.Equal(t, http.StatusBadRequest, resp.StatusCode, alias)
+			}
+
+			// пакет с псевдонимами
+			batch := []aliasBatchItem{
+				{CorrelationID: "0", OriginalURL: "https://yandex.ru/b0", Alias: "summer-sale"},
+				{CorrelationID: "1", OriginalURL: "https://yandex.ru/b1", Alias: "spring-sale"},
+				{CorrelationID: "2", OriginalURL: "https://yandex.ru/b2", Alias: "summer-sale"},
+				{CorrelationID: "3", OriginalURL: "https://yandex.ru/b3", Alias: "debug"},
+				{CorrelationID: "4", OriginalURL: "https://yandex.ru/sale", Alias: "spring-sale"},
+				{CorrelationID: "5", OriginalURL: "https://yandex.ru/b5"},
+			}
+			buf, err := json.Marshal(batch)
+			require.NoError(t, err)
+			resp, body = testRequest(t, ts.URL+"/api/shorten/batch", http.MethodPost, bytes.NewBuffer(buf))
+			require.Equal(t, http.StatusCreated, resp.StatusCode)
+			var output []batchOutputItem
+			require.NoError(t, json.Unmarshal([]byte(body), &output))
+			require.Len(t, output, len(batch))
+			require.Equal(t, batchOutputItem{CorrelationID: "0", ShortURL: *BaseURL + "/summer-sale", Status: "created"}, output[0])
+			require.Equal(t, batchOutputItem{CorrelationID: "1", Status: "alias_taken"}, output[1])
+			require.Equal(t, batchOutputItem{CorrelationID: "2", Status: "alias_taken"}, output[2])
+			require.Equal(t, batchOutputItem{CorrelationID: "3", Status: "invalid"}, output[3])
+			require.Equal(t, batchOutputItem{CorrelationID: "4", ShortURL: *BaseURL + "/spring-sale", Status: "exists"}, output[4])
+			require.Equal(t, "created", output[5].Status)
+
+			resp, _ = testRequest(t, ts.URL+"/summer-sale", http.MethodGet, nil)
+			require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+			require.Equal(t, "https://yandex.ru/b0", resp.Header.Get("Location"))
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package app
+
+import (
+	"context"
+	"github.com/antonevtu/go_shortener_adv/internal/backend"
+	"github.com/antonevtu/go_shortener_adv/internal/cfg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+)
+
+func TestBackendSelection(t *testing.T) {
+	_ = os.Remove(*FileStoragePath)
+	ctx := context.Background()
+
+	// implicit selection keeps previous behaviour
+	assert.Equal(t, backend.Postgres, backend.Name(cfg.Config{DatabaseDSN: "postgres://localhost", FileStoragePath: *FileStoragePath}))
+	assert.Equal(t, backend.File, backend.Name(cfg.Config{FileStoragePath: *FileStoragePath}))
+	assert.Equal(t, backend.Memory, backend.Name(cfg.Config{}))
+	assert.Equal(t, "FILE_STORAGE_PATH (-f)", backend.InferredFrom(cfg.Config{FileStoragePath: *FileStoragePath}))
+	assert.Empty(t, backend.InferredFrom(cfg.Config{StorageBackend: backend.File, FileStoragePath: *FileStoragePath}))
+
+	// explicit selection wins
+	repo, err := backend.Open(ctx, cfg.Config{StorageBackend: backend.Memory, FileStoragePath: *FileStoragePath})
+	require.NoError(t, err)
+	repo.Close()
+	_, err = os.Stat(*FileStoragePath)
+	assert.True(t, os.IsNotExist(err))
+
+	repo, err = backend.Open(ctx, cfg.Config{StorageBackend: backend.File, FileStoragePath: *FileStoragePath, FileSync: "never"})
+	require.NoError(t, err)
+	repo.Close()
+	_, err = os.Stat(*FileStoragePath)
+	assert.NoError(t, err)
+
+	// misconfigured backends fail loudly
+	for _, cfgApp := range []cfg.Config{
+		{StorageBackend: backend.Postgres, FileStoragePath: *FileStoragePath},
+		{StorageBackend: backend.File, FileStoragePath: *FileStoragePath, DatabaseDSN: "postgres://localhost"},
+		{StorageBackend: backend.SQLite, SQLitePath: "storage.db", DatabaseDSN: "postgres://localhost"},
+		{StorageBackend: backend.File},
+		{StorageBackend: backend.File, FileStoragePath: *FileStoragePath, FileSync: "sometimes"},
+		{StorageBackend: "mongo"},
+	} {
+		_, err = backend.Open(ctx, cfgApp)
+		assert.Error(t, err, cfgApp.StorageBackend)
+	}
+}
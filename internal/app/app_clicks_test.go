@@ -0,0 +1,185 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/antonevtu/go_shortener_adv/internal/backend"
+	"github.com/antonevtu/go_shortener_adv/internal/clicks"
+	"github.com/antonevtu/go_shortener_adv/internal/handlers"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type statsResponse struct {
+	ShortURL string `json:"short_url"`
+	clicks.Stats
+}
+
+func TestClickStats(t *testing.T) {
+	for _, name := range testBackends {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			cfgApp := newTestConfig(t, name)
+			repo, err := backend.Open(ctx, cfgApp)
+			require.NoError(t, err)
+			store, ok := repo.(clicks.Store)
+			require.True(t, ok)
+			// writer needs store, so it is started after repository is opened and before router is built
+			writer := clicks.New(ctx, store, clicks.WithBatching(2, 10*time.Millisecond))
+			cfgApp.ClickWriter = &writer
+			ts := httptest.NewServer(handlers.NewRouter(repo, cfgApp))
+			defer ts.Close()
+
+			resp, shortURL := testGZipRequest(t, ts.URL, http.MethodPost, bytes.NewBufferString("https://yandex.ru/stats"))
+			require.Equal(t, http.StatusCreated, resp.StatusCode)
+			cookies := resp.Cookies()
+			shortID := strings.TrimPrefix(shortURL, *BaseURL+"/")
+
+			// переходы с разными источниками и клиентами
+			for _, h := range []struct{ referer, agent string }{
+				{"https://www.Google.com/search?q=x", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) Chrome/99.0"},
+				{"https://google.com/", "Mozilla/5.0 (iPhone; CPU iPhone OS 15_0 like Mac OS X) Mobile/15E148"},
+				{"", "curl/7.79.1"},
+				{"", "Googlebot/2.1 (+http://www.google.com/bot.html)"},
+			} {
+				req, err := http.NewRequest(http.MethodGet, ts.URL+"/"+shortID, nil)
+				require.NoError(t, err)
+				req.Header.Set("Referer", h.referer)
+				req.Header.Set("User-Agent", h.agent)
+				resp, err := http.DefaultTransport.RoundTrip(req)
+				require.NoError(t, err)
+				resp.Body.Close()
+				require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+			}
+
+			getStats := func(path string, cookies []*http.Cookie) (*http.Response, statsResponse) {
+				req, err := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+				require.NoError(t, err)
+				for _, c := range cookies {
+					req.AddCookie(c)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				require.NoError(t, err)
+				defer resp.Body.Close()
+				body, err := ioutil.ReadAll(resp.Body)
+				require.NoError(t, err)
+				var stats statsResponse
+				if resp.StatusCode == http.StatusOK {
+					require.NoError(t, json.Unmarshal(body, &stats))
+				}
+				return resp, stats
+			}
+
+			// клики записываются асинхронно
+			var stats statsResponse
+			require.Eventually(t, func() bool {
+				resp, stats = getStats("/api/user/urls/"+shortID+"/stats", cookies)
+				return resp.StatusCode == http.StatusOK && stats.Total == 4
+			}, 2*time.Second, 10*time.Millisecond)
+			require.Equal(t, shortURL, stats.ShortURL)
+			require.Equal(t, clicks.Day, stats.Bucket)
+			require.Len(t, stats.Buckets, 31)
+			require.Equal(t, int64(4), stats.Buckets[len(stats.Buckets)-1].Count)
+			require.Equal(t, map[string]int64{"google.com": 2, clicks.DirectReferrer: 2}, stats.Referrers)
+			require.Equal(t, map[clicks.AgentClass]int64{
+				clicks.AgentBrowser: 1, clicks.AgentMobile: 1, clicks.AgentCLI: 1, clicks.AgentBot: 1,
+			}, stats.Agents)
+
+			// почасовая статистика за заданный период
+			now := time.Now().UTC()
+			path := "/api/user/urls/" + shortID + "/stats?bucket=hour&from=" + now.Add(-3*time.Hour).Format(time.RFC3339) +
+				"&to=" + now.Add(time.Hour).Format(time.RFC3339)
+			resp, stats = getStats(path, cookies)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			var sum int64
+			for _, b := range stats.Buckets {
+				require.Equal(t, b.Start, b.Start.Truncate(time.Hour))
+				sum += b.Count
+			}
+			require.Equal(t, int64(4), sum)
+
+			// период без переходов
+			resp, stats = getStats("/api/user/urls/"+shortID+"/stats?to="+now.Add(-48*time.Hour).Format(time.RFC3339), cookies)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, int64(4), stats.Total)
+			require.Empty(t, stats.Referrers)
+
+			// ошибки запроса
+			resp, _ = getStats("/api/user/urls/"+shortID+"/stats?bucket=week", cookies)
+			require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+			resp, _ = getStats("/api/user/urls/"+shortID+"/stats?bucket=hour&from=2000-01-01T00:00:00Z", cookies)
+			require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+			resp, _ = getStats("/api/user/urls/unknown/stats", cookies)
+			require.Equal(t, http.StatusNotFound, resp.StatusCode)
+			// чужая ссылка не найдена
+			resp, _ = getStats("/api/user/urls/"+shortID+"/stats", nil)
+			require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+			// остаток буфера записывается при остановке
+			writer.Record(clicks.NewClick(shortID, "", "", time.Now()))
+			cancel()
+			writer.Close()
+			stored, err := store.ClickStats(context.Background(), clicks.Query{ShortID: shortID, From: now.Add(-time.Hour), To: now.Add(time.Hour), Bucket: clicks.Hour})
+			require.NoError(t, err)
+			require.Equal(t, int64(5), stored.Total)
+
+			// клики сохраняются после перезапуска
+			repo.Close()
+			if name == backend.Memory {
+				return
+			}
+			repo, err = backend.Open(context.Background(), cfgApp)
+			require.NoError(t, err)
+			defer repo.Close()
+			stored, err = repo.(clicks.Store).ClickStats(context.Background(), clicks.Query{ShortID: shortID, From: now.Add(-time.Hour), To: now.Add(time.Hour), Bucket: clicks.Hour})
+			require.NoError(t, err)
+			require.Equal(t, int64(5), stored.Total)
+			require.Equal(t, int64(2), stored.Agents[clicks.AgentOther]+stored.Agents[clicks.AgentBot])
+		})
+	}
+}
+
+type blockingClicks struct {
+	release chan struct{}
+}
+
+func (b *blockingClicks) AddClicks(ctx context.Context, _ []clicks.Click) error {
+	select {
+	case <-b.release:
+	case <-ctx.Done():
+	}
+	return nil
+}
+
+func (b *blockingClicks) ClickStats(_ context.Context, q clicks.Query) (clicks.Stats, error) {
+	return clicks.NewStats(q), nil
+}
+
+// переполненный буфер не блокирует переходы, лишние клики отбрасываются
+func TestClickWriterDrops(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	store := &blockingClicks{release: make(chan struct{})}
+	writer := clicks.New(ctx, store, clicks.WithBuffer(2), clicks.WithBatching(1, time.Hour))
+
+	accepted := 0
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if writer.Record(clicks.Click{ShortID: "x", Time: time.Now()}) {
+			accepted++
+		}
+	}
+	require.Less(t, time.Since(start), time.Second)
+	require.LessOrEqual(t, accepted, 3) // буфер и пакет, ожидающий записи
+	require.Equal(t, int64(10-accepted), writer.Dropped())
+
+	close(store.release)
+	cancel()
+	writer.Close()
+}
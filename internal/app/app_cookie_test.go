@@ -13,11 +13,12 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"testing"
 )
 
 func TestCookie(t *testing.T) {
-	//_ = os.Remove(cfgApp.FileStoragePath)
+	_ = os.Remove(*FileStoragePath)
 	cfgApp := cfg.Config{
 		ServerAddress:   *ServerAddress,
 		BaseURL:         *BaseURL,
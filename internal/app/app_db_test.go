@@ -9,6 +9,7 @@ type batchOutput []batchOutputItem
 type batchOutputItem struct {
 	CorrelationID string `json:"correlation_id"`
 	ShortURL      string `json:"short_url"`
+	Status        string `json:"status"`
 }
 
 /*
@@ -4,11 +4,14 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/antonevtu/go_shortener_adv/internal/backend"
 	"github.com/antonevtu/go_shortener_adv/internal/cfg"
 	"github.com/antonevtu/go_shortener_adv/internal/db"
 	"github.com/antonevtu/go_shortener_adv/internal/handlers"
 	"github.com/antonevtu/go_shortener_adv/internal/pool"
+	"github.com/antonevtu/go_shortener_adv/internal/repository"
 	"github.com/docker/go-connections/nat"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v4/pgxpool"
@@ -20,6 +23,11 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -56,19 +64,13 @@ func TestDBDeleteBatch(t *testing.T) {
 	// пул горутин на удаление записей
 	deleterPool := pool.New(context.Background(), &dbPool)
 	//defer deleterPool.Close()
-	cfgApp.DeleterChan = deleterPool.Input
+	cfgApp.DeleterPool = &deleterPool
 	r := handlers.NewRouter(&dbPool, cfgApp)
 	ts := httptest.NewServer(r)
 	defer ts.Close()
 
 	// создание таблицы
-	sql1 := "create table if not exists urls (" +
-		"id serial primary key, " +
-		"deleted boolean not null," +
-		"user_id varchar(512) not null, " +
-		"short_id varchar(512) not null unique, " +
-		"long_url varchar(1024) not null unique)"
-	_, err = dbPool.Exec(ctx, sql1)
+	err = dbPool.MigrateUp(ctx)
 	require.NoError(t, err)
 
 	// запись в БД
@@ -109,6 +111,561 @@ func TestDBDeleteBatch(t *testing.T) {
 	time.Sleep(time.Second)
 }
 
+func TestFileDelete(t *testing.T) {
+	_ = os.Remove(*FileStoragePath)
+	cfgApp := cfg.Config{
+		ServerAddress:   *ServerAddress,
+		BaseURL:         *BaseURL,
+		FileStoragePath: *FileStoragePath,
+		DatabaseDSN:     *DatabaseDSN,
+		CtxTimeout:      *CtxTimeout,
+	}
+
+	repo, err := repository.New(*FileStoragePath)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	deleterPool := pool.New(ctx, repo)
+	cfgApp.DeleterPool = &deleterPool
+	ts := httptest.NewServer(handlers.NewRouter(repo, cfgApp))
+
+	// запись в хранилище
+	batch := batchInput{
+		{CorrelationID: "0", OriginalURL: "https://yandex.ru/" + uuid.NewString()},
+		{CorrelationID: "1", OriginalURL: "https://yandex.ru/" + uuid.NewString()},
+	}
+	jsonBatch, err := json.Marshal(batch)
+	require.NoError(t, err)
+	resp, respBody := testRequest(t, ts.URL+"/api/shorten/batch", http.MethodPost, bytes.NewBuffer(jsonBatch))
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	cookies := resp.Cookies()
+	var batchOut batchOutput
+	err = json.Unmarshal([]byte(respBody), &batchOut)
+	require.NoError(t, err)
+	paths := make([]string, len(batchOut))
+	for i, v := range batchOut {
+		u, err := url.Parse(v.ShortURL)
+		require.NoError(t, err)
+		paths[i] = u.Path
+	}
+
+	// Запрос на удаление от другого пользователя игнорируется
+	resp, _ = testGZipRequestCookie(t, ts.URL+"/api/user/urls", http.MethodDelete, testEncodeJSONDeleteList(shortIDList{paths[1][1:]}), nil)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	// Запрос на удаление первой ссылки владельцем
+	resp, _ = testGZipRequestCookie(t, ts.URL+"/api/user/urls", http.MethodDelete, testEncodeJSONDeleteList(shortIDList{paths[0][1:]}), cookies)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	require.Eventually(t, func() bool {
+		resp, _ := testRequest(t, ts.URL+paths[0], http.MethodGet, nil)
+		return resp.StatusCode == http.StatusGone
+	}, time.Second, 10*time.Millisecond)
+	resp, _ = testRequest(t, ts.URL+paths[1], http.MethodGet, nil)
+	require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+
+	ts.Close()
+	cancel()
+	deleterPool.Close()
+	repo.Close()
+
+	// Удаление восстанавливается из файла
+	repo, err = repository.New(*FileStoragePath)
+	require.NoError(t, err)
+	defer repo.Close()
+	ts = httptest.NewServer(handlers.NewRouter(repo, cfgApp))
+	defer ts.Close()
+	resp, _ = testRequest(t, ts.URL+paths[0], http.MethodGet, nil)
+	require.Equal(t, http.StatusGone, resp.StatusCode)
+	resp, _ = testRequest(t, ts.URL+paths[1], http.MethodGet, nil)
+	require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+}
+
+// пакетное удаление возвращает только ID, принадлежащие пользователю
+func TestSetDeletedBatch(t *testing.T) {
+	for _, name := range testBackends {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			cfgApp := cfg.Config{
+				StorageBackend:  name,
+				FileStoragePath: filepath.Join(dir, "storage.txt"),
+				FileSync:        "never",
+				SQLitePath:      filepath.Join(dir, "storage.db"),
+			}
+			ctx := context.Background()
+			repo, err := backend.Open(ctx, cfgApp)
+			require.NoError(t, err)
+			defer repo.Close()
+
+			owner, other := uuid.NewString(), uuid.NewString()
+			err = repo.AddEntityBatch(ctx, owner, db.BatchInput{
+				{OriginalURL: "https://yandex.ru/0", ShortID: "owner0"},
+				{OriginalURL: "https://yandex.ru/1", ShortID: "owner1"},
+			})
+			require.NoError(t, err)
+			err = repo.AddEntityBatch(ctx, other, db.BatchInput{{OriginalURL: "https://yandex.ru/2", ShortID: "other"}})
+			require.NoError(t, err)
+
+			deleted, err := repo.SetDeletedBatch(ctx, owner, []string{"owner0", "other", "unknown"})
+			require.NoError(t, err)
+			require.Equal(t, []string{"owner0"}, deleted)
+
+			for shortID, want := range map[string]bool{"owner0": true, "owner1": false, "other": false} {
+				e, err := repo.SelectByShortID(ctx, shortID)
+				require.NoError(t, err)
+				require.Equal(t, want, e.Deleted, shortID)
+			}
+
+			// повторное удаление идемпотентно, уже удалённые ID не возвращаются
+			deleted, err = repo.SetDeletedBatch(ctx, owner, []string{"owner0", "owner1"})
+			require.NoError(t, err)
+			require.Equal(t, []string{"owner1"}, deleted)
+			deleted, err = repo.SetDeletedBatch(ctx, owner, []string{"owner0", "owner1"})
+			require.NoError(t, err)
+			require.Empty(t, deleted)
+		})
+	}
+}
+
+// countingRepo counts batch delete calls of wrapped repository
+type countingRepo struct {
+	backend.Repository
+	calls int64
+}
+
+func (c *countingRepo) SetDeletedBatch(ctx context.Context, userID string, shortIDs []string) ([]string, error) {
+	atomic.AddInt64(&c.calls, 1)
+	return c.Repository.SetDeletedBatch(ctx, userID, shortIDs)
+}
+
+// пул на удаление объединяет ссылки пользователя в пакеты
+func TestDeleterBatching(t *testing.T) {
+	cfgApp := cfg.Config{
+		ServerAddress: *ServerAddress,
+		BaseURL:       *BaseURL,
+		CtxTimeout:    *CtxTimeout,
+	}
+	memory, err := repository.New("")
+	require.NoError(t, err)
+	repo := &countingRepo{Repository: memory}
+	ctx, cancel := context.WithCancel(context.Background())
+	deleterPool := pool.New(ctx, repo, pool.WithBatching(1000, 50*time.Millisecond))
+	cfgApp.DeleterPool = &deleterPool
+	ts := httptest.NewServer(handlers.NewRouter(repo, cfgApp))
+	defer ts.Close()
+
+	batch := make(batchInput, 200)
+	for i := range batch {
+		batch[i] = batchInputItem{CorrelationID: strconv.Itoa(i), OriginalURL: "https://yandex.ru/" + uuid.NewString()}
+	}
+	jsonBatch, err := json.Marshal(batch)
+	require.NoError(t, err)
+	resp, respBody := testRequest(t, ts.URL+"/api/shorten/batch", http.MethodPost, bytes.NewBuffer(jsonBatch))
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var batchOut batchOutput
+	err = json.Unmarshal([]byte(respBody), &batchOut)
+	require.NoError(t, err)
+	shortIDs := make(shortIDList, len(batchOut))
+	for i, v := range batchOut {
+		u, err := url.Parse(v.ShortURL)
+		require.NoError(t, err)
+		shortIDs[i] = u.Path[1:]
+	}
+
+	resp, _ = testGZipRequestCookie(t, ts.URL+"/api/user/urls", http.MethodDelete, testEncodeJSONDeleteList(shortIDs), resp.Cookies())
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	require.Eventually(t, func() bool {
+		for _, shortID := range shortIDs {
+			if e, _ := repo.SelectByShortID(ctx, shortID); !e.Deleted {
+				return false
+			}
+		}
+		return true
+	}, time.Second, 10*time.Millisecond)
+
+	// не более одного вызова на каждый из 4 воркеров за интервал задержки
+	require.LessOrEqual(t, atomic.LoadInt64(&repo.calls), int64(8))
+	cancel()
+	deleterPool.Close()
+}
+
+// при остановке пул без журнала удаляет оставшиеся в очереди ссылки
+func TestDeleterDrain(t *testing.T) {
+	repo, err := repository.New("")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	userID := uuid.NewString()
+	input := make(db.BatchInput, 10)
+	items := make([]pool.ToDeleteItem, len(input))
+	for i := range input {
+		input[i] = db.BatchInputItem{OriginalURL: "https://yandex.ru/" + strconv.Itoa(i), ShortID: "drain" + strconv.Itoa(i)}
+		items[i] = pool.ToDeleteItem{UserID: userID, ShortID: input[i].ShortID}
+	}
+	require.NoError(t, repo.AddEntityBatch(ctx, userID, input))
+
+	// пакет не набирается и задержка не истекает до остановки
+	deleterPool := pool.New(ctx, repo, pool.WithBatching(1000, time.Hour))
+	require.NoError(t, deleterPool.Enqueue(ctx, items))
+	cancel()
+	deleterPool.Close()
+
+	for _, item := range items {
+		e, err := repo.SelectByShortID(context.Background(), item.ShortID)
+		require.NoError(t, err)
+		require.True(t, e.Deleted, item.ShortID)
+	}
+}
+
+// failingRepo fails batch deletes while broken is set
+type failingRepo struct {
+	backend.Repository
+	broken int32
+	calls  int64
+}
+
+func (f *failingRepo) SetDeletedBatch(ctx context.Context, userID string, shortIDs []string) ([]string, error) {
+	atomic.AddInt64(&f.calls, 1)
+	if atomic.LoadInt32(&f.broken) == 1 {
+		return nil, errors.New("database is unavailable")
+	}
+	return f.Repository.SetDeletedBatch(ctx, userID, shortIDs)
+}
+
+// ошибки хранилища не останавливают сервер: удаления повторяются, затем попадают в dead letters
+func TestDeleterDeadLetters(t *testing.T) {
+	cfgApp := cfg.Config{
+		ServerAddress: *ServerAddress,
+		BaseURL:       *BaseURL,
+		CtxTimeout:    *CtxTimeout,
+	}
+	memory, err := repository.New("")
+	require.NoError(t, err)
+	repo := &failingRepo{Repository: memory, broken: 1}
+	ctx, cancel := context.WithCancel(context.Background())
+	deleterPool := pool.New(ctx, repo,
+		pool.WithBatching(10, 10*time.Millisecond),
+		pool.WithRetry(3, time.Millisecond, 5*time.Millisecond))
+	cfgApp.DeleterPool = &deleterPool
+	ts := httptest.NewServer(handlers.NewRouter(repo, cfgApp))
+	defer ts.Close()
+
+	resp, shortURL := testRequest(t, ts.URL, http.MethodPost, bytes.NewBufferString("https://yandex.ru/"+uuid.NewString()))
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	cookies := resp.Cookies()
+	u, err := url.Parse(shortURL)
+	require.NoError(t, err)
+
+	resp, _ = testGZipRequestCookie(t, ts.URL+"/api/user/urls", http.MethodDelete, testEncodeJSONDeleteList(shortIDList{u.Path[1:]}), cookies)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	var dead []pool.DeadItem
+	require.Eventually(t, func() bool {
+		_, body := testRequest(t, ts.URL+"/debug/deleter/dead", http.MethodGet, nil)
+		return json.Unmarshal([]byte(body), &dead) == nil && len(dead) == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, u.Path[1:], dead[0].ShortID)
+	require.Equal(t, testUserID(t, cookies), dead[0].UserID)
+	require.Equal(t, 3, dead[0].Attempts)
+	require.Equal(t, int64(3), atomic.LoadInt64(&repo.calls))
+	job, ok := deleterPool.Job(dead[0].JobID)
+	require.True(t, ok)
+	require.Equal(t, "done", job.Status)
+	require.Equal(t, pool.OutcomeFailed, job.Items[0].Outcome)
+
+	// сервер продолжает работать
+	resp, _ = testRequest(t, ts.URL+u.Path, http.MethodGet, nil)
+	require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+
+	// после восстановления хранилища удаления повторяются
+	atomic.StoreInt32(&repo.broken, 0)
+	resp, body := testRequest(t, ts.URL+"/debug/deleter/dead/replay", http.MethodPost, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.JSONEq(t, `{"replayed":1}`, body)
+	require.Eventually(t, func() bool {
+		resp, _ := testRequest(t, ts.URL+u.Path, http.MethodGet, nil)
+		return resp.StatusCode == http.StatusGone
+	}, time.Second, 10*time.Millisecond)
+	require.Empty(t, deleterPool.DeadLetters())
+	job, _ = deleterPool.Job(dead[0].JobID)
+	require.Equal(t, pool.OutcomeDeleted, job.Items[0].Outcome)
+
+	cancel()
+	deleterPool.Close()
+}
+
+// принятые удаления журналируются и завершаются после перезапуска вместе со статусом задачи
+func TestDeleteJournal(t *testing.T) {
+	for _, name := range []string{backend.File, backend.SQLite} {
+		t.Run(name, func(t *testing.T) {
+			// удаления не выполняются до перезапуска
+			deleterPool := new(pool.DeleterPoolT)
+			cfgApp, repo, ts := newTestServer(t, name, func(c *cfg.Config) { c.DeleterPool = deleterPool })
+			journal, ok := repo.(pool.Journal)
+			require.True(t, ok)
+			ctx, cancel := context.WithCancel(context.Background())
+			*deleterPool = pool.New(ctx, &failingRepo{Repository: repo, broken: 1},
+				pool.WithJournal(journal), pool.WithRetry(1, time.Millisecond, time.Millisecond))
+
+			resp, shortURL := testRequest(t, ts.URL, http.MethodPost, bytes.NewBufferString("https://yandex.ru/"+uuid.NewString()))
+			require.Equal(t, http.StatusCreated, resp.StatusCode)
+			cookies := resp.Cookies()
+			u, err := url.Parse(shortURL)
+			require.NoError(t, err)
+			resp, body := testGZipRequestCookie(t, ts.URL+"/api/user/urls", http.MethodDelete, testEncodeJSONDeleteList(shortIDList{u.Path[1:]}), cookies)
+			require.Equal(t, http.StatusAccepted, resp.StatusCode)
+			var job pool.Job
+			require.NoError(t, json.Unmarshal([]byte(body), &struct {
+				JobID *string `json:"job_id"`
+			}{&job.ID}))
+			pending, err := journal.PendingDeletes(ctx)
+			require.NoError(t, err)
+			require.Len(t, pending, 1)
+			require.Equal(t, job.ID, pending[0].JobID)
+
+			ts.Close()
+			cancel()
+			deleterPool.Close()
+			repo.Close()
+
+			// после перезапуска пул продолжает работу из журнала, задача доступна по прежнему ID
+			repo, err = backend.Open(context.Background(), cfgApp)
+			require.NoError(t, err)
+			defer repo.Close()
+			journal = repo.(pool.Journal)
+			ctx, cancel = context.WithCancel(context.Background())
+			*deleterPool = pool.New(ctx, repo, pool.WithJournal(journal))
+			defer func() {
+				cancel()
+				deleterPool.Close()
+			}()
+			ts = httptest.NewServer(handlers.NewRouter(repo, cfgApp))
+			defer ts.Close()
+			require.Eventually(t, func() bool {
+				resp, _ := testRequest(t, ts.URL+u.Path, http.MethodGet, nil)
+				return resp.StatusCode == http.StatusGone
+			}, time.Second, 10*time.Millisecond)
+			require.Eventually(t, func() bool {
+				pending, err := journal.PendingDeletes(ctx)
+				return err == nil && len(pending) == 0
+			}, time.Second, 10*time.Millisecond)
+			resp, body = testGZipRequestCookie(t, ts.URL+"/api/user/jobs/"+job.ID, http.MethodGet, bytes.NewBufferString(""), cookies)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.NoError(t, json.Unmarshal([]byte(body), &job))
+			require.Equal(t, pool.JobDone, job.Status)
+			require.Equal(t, []pool.JobItem{{ShortID: u.Path[1:], Outcome: pool.OutcomeDeleted}}, job.Items)
+		})
+	}
+}
+
+// blockingRepo holds batch deletes until release is closed
+type blockingRepo struct {
+	backend.Repository
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingRepo) SetDeletedBatch(ctx context.Context, userID string, shortIDs []string) ([]string, error) {
+	select {
+	case b.entered <- struct{}{}:
+	default:
+	}
+	<-b.release
+	return b.Repository.SetDeletedBatch(ctx, userID, shortIDs)
+}
+
+// переполнение очереди удаления отклоняется с 503 и Retry-After, большие запросы - с 413
+func TestDeleteAdmission(t *testing.T) {
+	cfgApp := cfg.Config{
+		ServerAddress: *ServerAddress,
+		BaseURL:       *BaseURL,
+		CtxTimeout:    *CtxTimeout,
+		DeleteMaxIDs:  3,
+		DeleteTimeout: 50 * time.Millisecond,
+	}
+	memory, err := repository.New("")
+	require.NoError(t, err)
+	repo := &blockingRepo{Repository: memory, entered: make(chan struct{}, 1), release: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	deleterPool := pool.New(ctx, repo, pool.WithWorkers(1), pool.WithQueueSize(2), pool.WithBatching(1, time.Millisecond))
+	cfgApp.DeleterPool = &deleterPool
+	ts := httptest.NewServer(handlers.NewRouter(repo, cfgApp))
+	defer ts.Close()
+
+	resp, _ := testGZipRequestCookie(t, ts.URL+"/api/user/urls", http.MethodDelete, testEncodeJSONDeleteList(shortIDList{"a", "b", "c", "d"}), nil)
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	// запрос больше очереди не поместится в неё никогда
+	resp, _ = testGZipRequestCookie(t, ts.URL+"/api/user/urls", http.MethodDelete, testEncodeJSONDeleteList(shortIDList{"a", "b", "c"}), nil)
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	// единственный воркер занят, очередь заполнена
+	resp, _ = testGZipRequestCookie(t, ts.URL+"/api/user/urls", http.MethodDelete, testEncodeJSONDeleteList(shortIDList{"a"}), nil)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	<-repo.entered
+	resp, _ = testGZipRequestCookie(t, ts.URL+"/api/user/urls", http.MethodDelete, testEncodeJSONDeleteList(shortIDList{"b", "c"}), nil)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	resp, _ = testGZipRequestCookie(t, ts.URL+"/api/user/urls", http.MethodDelete, testEncodeJSONDeleteList(shortIDList{"d"}), nil)
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, "1", resp.Header.Get("Retry-After"))
+
+	// после освобождения воркера запросы снова принимаются
+	close(repo.release)
+	resp, _ = testGZipRequestCookie(t, ts.URL+"/api/user/urls", http.MethodDelete, testEncodeJSONDeleteList(shortIDList{"d"}), nil)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	cancel()
+	deleterPool.Close()
+}
+
+// без пула удаления запросы на удаление отклоняются
+func TestDeleteWithoutPool(t *testing.T) {
+	_, _, ts := newTestServer(t, backend.Memory, nil)
+	resp, _ := testGZipRequestCookie(t, ts.URL+"/api/user/urls", http.MethodDelete, testEncodeJSONDeleteList(shortIDList{"a"}), nil)
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	resp, _ = testGZipRequestCookie(t, ts.URL+"/api/user/jobs/x", http.MethodGet, bytes.NewBufferString(""), nil)
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+// запрос на удаление создает задачу с результатом по каждому ID
+func TestDeleteJobs(t *testing.T) {
+	cfgApp := cfg.Config{
+		ServerAddress: *ServerAddress,
+		BaseURL:       *BaseURL,
+		CtxTimeout:    *CtxTimeout,
+	}
+	repo, err := repository.New("")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	deleterPool := pool.New(ctx, repo, pool.WithOwnerLookup(backend.OwnerLookup(repo)), pool.WithBatching(10, 10*time.Millisecond))
+	cfgApp.DeleterPool = &deleterPool
+	ts := httptest.NewServer(handlers.NewRouter(repo, cfgApp))
+	defer ts.Close()
+
+	shorten := func(cookies []*http.Cookie) (string, []*http.Cookie) {
+		resp, shortURL := testGZipRequestCookie(t, ts.URL, http.MethodPost, bytes.NewBufferString("https://yandex.ru/"+uuid.NewString()), cookies)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		u, err := url.Parse(shortURL)
+		require.NoError(t, err)
+		return u.Path[1:], resp.Cookies()
+	}
+	own, cookies := shorten(nil)
+	foreign, otherCookies := shorten(nil)
+
+	resp, body := testGZipRequestCookie(t, ts.URL+"/api/user/urls", http.MethodDelete,
+		testEncodeJSONDeleteList(shortIDList{own, foreign, "unknown", own}), cookies)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	var jobID struct {
+		JobID string `json:"job_id"`
+	}
+	err = json.Unmarshal([]byte(body), &jobID)
+	require.NoError(t, err)
+	require.NotEmpty(t, jobID.JobID)
+	require.Equal(t, *BaseURL+"/api/user/jobs/"+jobID.JobID, resp.Header.Get("Location"))
+
+	type jobStatus struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+		Items  []struct {
+			ShortID string `json:"short_id"`
+			Status  string `json:"status"`
+		} `json:"items"`
+	}
+	var job jobStatus
+	require.Eventually(t, func() bool {
+		resp, body := testGZipRequestCookie(t, ts.URL+"/api/user/jobs/"+jobID.JobID, http.MethodGet, bytes.NewBufferString(""), cookies)
+		return resp.StatusCode == http.StatusOK && json.Unmarshal([]byte(body), &job) == nil && job.Status == "done"
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, jobID.JobID, job.ID)
+	require.Len(t, job.Items, 3)
+	outcomes := make(map[string]string)
+	for _, v := range job.Items {
+		outcomes[v.ShortID] = v.Status
+	}
+	require.Equal(t, map[string]string{own: "deleted", foreign: "forbidden", "unknown": "not_found"}, outcomes)
+
+	// задача другого пользователя не видна
+	resp, _ = testGZipRequestCookie(t, ts.URL+"/api/user/jobs/"+jobID.JobID, http.MethodGet, bytes.NewBufferString(""), otherCookies)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = testGZipRequestCookie(t, ts.URL+"/api/user/jobs/"+uuid.NewString(), http.MethodGet, bytes.NewBufferString(""), cookies)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	cancel()
+	deleterPool.Close()
+}
+
+// slowRepo delays batch deletes and records users in order of calls
+type slowRepo struct {
+	backend.Repository
+	lock  sync.Mutex
+	users []string
+}
+
+func (s *slowRepo) SetDeletedBatch(ctx context.Context, userID string, shortIDs []string) ([]string, error) {
+	time.Sleep(5 * time.Millisecond)
+	s.lock.Lock()
+	s.users = append(s.users, userID)
+	s.lock.Unlock()
+	return s.Repository.SetDeletedBatch(ctx, userID, shortIDs)
+}
+
+// небольшое удаление выполняется, не дожидаясь массового удаления другого пользователя
+func TestDeleterFairness(t *testing.T) {
+	cfgApp := cfg.Config{
+		ServerAddress: *ServerAddress,
+		BaseURL:       *BaseURL,
+		CtxTimeout:    *CtxTimeout,
+	}
+	memory, err := repository.New("")
+	require.NoError(t, err)
+	repo := &slowRepo{Repository: memory}
+	ctx, cancel := context.WithCancel(context.Background())
+	deleterPool := pool.New(ctx, repo, pool.WithWorkers(1), pool.WithBatching(10, time.Millisecond))
+	cfgApp.DeleterPool = &deleterPool
+	ts := httptest.NewServer(handlers.NewRouter(repo, cfgApp))
+	defer ts.Close()
+
+	// массовое удаление: 50 пакетов
+	bulk := make(shortIDList, 500)
+	for i := range bulk {
+		bulk[i] = strconv.Itoa(i)
+	}
+	// пользователи получают cookie при сокращении
+	resp, _ := testRequest(t, ts.URL, http.MethodPost, bytes.NewBufferString("https://yandex.ru/"+uuid.NewString()))
+	bulkCookies := resp.Cookies()
+	resp, _ = testRequest(t, ts.URL, http.MethodPost, bytes.NewBufferString("https://yandex.ru/"+uuid.NewString()))
+	smallCookies := resp.Cookies()
+	bulkUser, smallUser := testUserID(t, bulkCookies), testUserID(t, smallCookies)
+
+	resp, _ = testGZipRequestCookie(t, ts.URL+"/api/user/urls", http.MethodDelete, testEncodeJSONDeleteList(bulk), bulkCookies)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	var stats pool.QueueStats
+	_, body := testRequest(t, ts.URL+"/debug/deleter/queue", http.MethodGet, nil)
+	err = json.Unmarshal([]byte(body), &stats)
+	require.NoError(t, err)
+	require.Greater(t, stats.Total, 0)
+	require.Equal(t, bulkUser, stats.Users[0].UserID)
+
+	resp, _ = testGZipRequestCookie(t, ts.URL+"/api/user/urls", http.MethodDelete, testEncodeJSONDeleteList(shortIDList{"small"}), smallCookies)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	// маленький запрос обслуживается в ближайшей очереди круга, а не после 50 пакетов
+	require.Eventually(t, func() bool {
+		repo.lock.Lock()
+		defer repo.lock.Unlock()
+		for _, userID := range repo.users {
+			if userID == smallUser {
+				return true
+			}
+		}
+		return false
+	}, time.Second, time.Millisecond)
+	repo.lock.Lock()
+	bulkBatches := len(repo.users) - 1
+	repo.lock.Unlock()
+	require.Less(t, bulkBatches, 10)
+
+	cancel()
+	deleterPool.Close()
+}
+
 func testEncodeJSONDeleteList(s shortIDList) *bytes.Buffer {
 	buf := bytes.NewBuffer([]byte{})
 	encoder := json.NewEncoder(buf)
@@ -0,0 +1,228 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/antonevtu/go_shortener_adv/internal/backend"
+	"github.com/antonevtu/go_shortener_adv/internal/db"
+	"github.com/antonevtu/go_shortener_adv/internal/reaper"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type expireHistoryItem struct {
+	ShortURL    string     `json:"short_url"`
+	OriginalURL string     `json:"original_url"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+}
+
+func TestExpiration(t *testing.T) {
+	for _, name := range testBackends {
+		t.Run(name, func(t *testing.T) {
+			cfgApp, repo, ts := newTestServer(t, name, nil)
+			ctx := context.Background()
+
+			// ttl в JSON API
+			before := time.Now()
+			resp, body := testGZipRequest(t, ts.URL+"/api/shorten", http.MethodPost,
+				bytes.NewBufferString(`{"url":"https://yandex.ru/ttl","ttl":3600}`))
+			require.Equal(t, http.StatusCreated, resp.StatusCode)
+			cookies := resp.Cookies()
+			var result struct {
+				Result string `json:"result"`
+			}
+			require.NoError(t, json.Unmarshal([]byte(body), &result))
+
+			// expires_at в параметрах текстового API
+			expiresAt := time.Now().Add(48 * time.Hour).UTC().Truncate(time.Second)
+			resp, _ = testGZipRequestCookie(t, ts.URL+"/?expires_at="+expiresAt.Format(time.RFC3339), http.MethodPost,
+				bytes.NewBufferString("https://yandex.ru/expires"), cookies)
+			require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+			// без срока действия
+			resp, _ = testGZipRequestCookie(t, ts.URL, http.MethodPost, bytes.NewBufferString("https://yandex.ru/forever"), cookies)
+			require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+			// срок действия в истории пользователя
+			resp, body = testGZipRequestCookie(t, ts.URL+"/api/user/urls", http.MethodGet, bytes.NewBufferString(""), cookies)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			var history []expireHistoryItem
+			require.NoError(t, json.Unmarshal([]byte(body), &history))
+			require.Len(t, history, 3)
+			require.Equal(t, result.Result, history[0].ShortURL)
+			require.NotNil(t, history[0].ExpiresAt)
+			require.WithinDuration(t, before.Add(time.Hour), *history[0].ExpiresAt, 2*time.Second)
+			require.NotNil(t, history[1].ExpiresAt)
+			require.True(t, expiresAt.Equal(*history[1].ExpiresAt))
+			require.Nil(t, history[2].ExpiresAt)
+
+			// недопустимые сроки
+			for _, req := range []string{
+				`{"url":"https://yandex.ru/bad","ttl":-1}`,
+				`{"url":"https://yandex.ru/bad","expires_at":"2001-01-01T00:00:00Z"}`,
+				`{"url":"https://yandex.ru/bad","ttl":60,"expires_at":"2101-01-01T00:00:00Z"}`,
+			} {
+				resp, _ = testRequest(t, ts.URL+"/api/shorten", http.MethodPost, bytes.NewBufferString(req))
+				require.Equal(t, http.StatusBadRequest, resp.StatusCode, req)
+			}
+			resp, _ = testRequest(t, ts.URL+"/?ttl=abc", http.MethodPost, bytes.NewBufferString("https://yandex.ru/bad"))
+			require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+			// срок в пакете
+			resp, body = testRequest(t, ts.URL+"/api/shorten/batch", http.MethodPost, bytes.NewBufferString(
+				`[{"correlation_id":"0","original_url":"https://yandex.ru/b0","ttl":60},`+
+					`{"correlation_id":"1","original_url":"https://yandex.ru/b1","ttl":-5}]`))
+			require.Equal(t, http.StatusCreated, resp.StatusCode)
+			var output []batchOutputItem
+			require.NoError(t, json.Unmarshal([]byte(body), &output))
+			require.Equal(t, "created", output[0].Status)
+			require.Equal(t, "invalid", output[1].Status)
+			e, err := repo.SelectByShortID(ctx, strings.TrimPrefix(output[0].ShortURL, *BaseURL+"/"))
+			require.NoError(t, err)
+			require.NotNil(t, e.ExpiresAt)
+
+			// истекшая ссылка отвечает 410 ещё до удаления
+			past := time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+			err = repo.AddEntity(ctx, db.Entity{UserID: "u", ShortID: "expired", LongURL: "https://yandex.ru/old", ExpiresAt: &past})
+			require.NoError(t, err)
+			resp, _ = testRequest(t, ts.URL+"/expired", http.MethodGet, nil)
+			require.Equal(t, http.StatusGone, resp.StatusCode)
+
+			// reaper помечает истекшие ссылки удалёнными
+			reaperCtx, cancel := context.WithCancel(ctx)
+			reaperDone := reaper.Run(reaperCtx, repo, 10*time.Millisecond)
+			require.Eventually(t, func() bool {
+				e, err := repo.SelectByShortID(ctx, "expired")
+				return err == nil && e.Deleted
+			}, time.Second, 10*time.Millisecond)
+			cancel()
+			<-reaperDone
+			n, err := repo.DeleteExpired(ctx, time.Now())
+			require.NoError(t, err)
+			require.Zero(t, n)
+
+			// через двое суток истекают ссылки со сроком
+			n, err = repo.DeleteExpired(ctx, time.Now().Add(72*time.Hour))
+			require.NoError(t, err)
+			require.Equal(t, int64(3), n)
+			e, err = repo.SelectByLongURL(ctx, "https://yandex.ru/forever")
+			require.NoError(t, err)
+			require.False(t, e.Deleted)
+
+			// срок и удаление сохраняются после перезапуска
+			repo.Close()
+			if name == backend.Memory {
+				return
+			}
+			repo, err = backend.Open(ctx, cfgApp)
+			require.NoError(t, err)
+			defer repo.Close()
+			e, err = repo.SelectByLongURL(ctx, "https://yandex.ru/expires")
+			require.NoError(t, err)
+			require.True(t, e.Deleted)
+			require.NotNil(t, e.ExpiresAt)
+			require.True(t, expiresAt.Equal(*e.ExpiresAt))
+		})
+	}
+}
+
+// истекшую или удалённую ссылку можно сократить заново с новым сроком,
+// а прежняя короткая ссылка остаётся у владельца и отвечает 410
+func TestExpiredReshorten(t *testing.T) {
+	for _, name := range testBackends {
+		t.Run(name, func(t *testing.T) {
+			cfgApp, repo, ts := newTestServer(t, name, nil)
+			ctx := context.Background()
+			past := time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+
+			// для истекшей ссылки создаётся новая
+			err := repo.AddEntity(ctx, db.Entity{UserID: "u", ShortID: "expired", LongURL: "https://yandex.ru/again", ExpiresAt: &past})
+			require.NoError(t, err)
+			resp, body := testRequest(t, ts.URL+"/api/shorten", http.MethodPost,
+				bytes.NewBufferString(`{"url":"https://yandex.ru/again","ttl":3600}`))
+			require.Equal(t, http.StatusCreated, resp.StatusCode)
+			shortURL := testDecodeJSONShortURL(t, body)
+			require.NotEqual(t, *BaseURL+"/expired", shortURL)
+			cookies := resp.Cookies()
+			resp, _ = testRequest(t, ts.URL+strings.TrimPrefix(shortURL, *BaseURL), http.MethodGet, nil)
+			require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+			require.Equal(t, "https://yandex.ru/again", resp.Header.Get("Location"))
+			resp, _ = testRequest(t, ts.URL+"/expired", http.MethodGet, nil)
+			require.Equal(t, http.StatusGone, resp.StatusCode)
+			e, err := repo.SelectByShortID(ctx, "expired")
+			require.NoError(t, err)
+			require.Equal(t, "u", e.UserID)
+
+			// живая ссылка не заменяется
+			resp, body = testRequest(t, ts.URL+"/api/shorten", http.MethodPost, bytes.NewBufferString(`{"url":"https://yandex.ru/again"}`))
+			require.Equal(t, http.StatusConflict, resp.StatusCode)
+			require.Equal(t, shortURL, testDecodeJSONShortURL(t, body))
+			e, err = repo.SelectByLongURL(ctx, "https://yandex.ru/again")
+			require.NoError(t, err)
+			require.Equal(t, testUserID(t, cookies), e.UserID)
+			require.NotNil(t, e.ExpiresAt)
+
+			// для удалённой ссылки создаётся новая
+			_, err = repo.SetDeletedBatch(ctx, e.UserID, []string{e.ShortID})
+			require.NoError(t, err)
+			resp, body = testRequest(t, ts.URL, http.MethodPost, bytes.NewBufferString("https://yandex.ru/again"))
+			require.Equal(t, http.StatusCreated, resp.StatusCode)
+			require.NotEqual(t, shortURL, body)
+			resp, _ = testRequest(t, ts.URL+strings.TrimPrefix(shortURL, *BaseURL), http.MethodGet, nil)
+			require.Equal(t, http.StatusGone, resp.StatusCode)
+			e, err = repo.SelectByLongURL(ctx, "https://yandex.ru/again")
+			require.NoError(t, err)
+			require.Equal(t, body, *BaseURL+"/"+e.ShortID)
+			require.False(t, e.Deleted)
+			require.Nil(t, e.ExpiresAt)
+
+			// удалённые reaper'ом ссылки: в пакете создаётся новая, псевдоним остаётся занят
+			_, err = repo.DeleteExpired(ctx, time.Now())
+			require.NoError(t, err)
+			for _, id := range []string{"reaped", "aliased"} {
+				err = repo.AddEntity(ctx, db.Entity{UserID: "u", ShortID: id, LongURL: "https://yandex.ru/" + id, ExpiresAt: &past})
+				require.NoError(t, err)
+			}
+			n, err := repo.DeleteExpired(ctx, time.Now())
+			require.NoError(t, err)
+			require.Equal(t, int64(2), n)
+			resp, body = testRequest(t, ts.URL+"/api/shorten/batch", http.MethodPost,
+				bytes.NewBufferString(`[{"correlation_id":"0","original_url":"https://yandex.ru/reaped","ttl":60}]`))
+			require.Equal(t, http.StatusCreated, resp.StatusCode)
+			var output []batchOutputItem
+			require.NoError(t, json.Unmarshal([]byte(body), &output))
+			require.Equal(t, "created", output[0].Status)
+			require.NotEqual(t, *BaseURL+"/reaped", output[0].ShortURL)
+			resp, _ = testRequest(t, ts.URL+"/api/shorten", http.MethodPost,
+				bytes.NewBufferString(`{"url":"https://yandex.ru/aliased","alias":"aliased"}`))
+			require.Equal(t, http.StatusConflict, resp.StatusCode)
+			for _, id := range []string{"reaped", "aliased"} {
+				resp, _ = testRequest(t, ts.URL+"/"+id, http.MethodGet, nil)
+				require.Equal(t, http.StatusGone, resp.StatusCode, id)
+			}
+
+			// новые и прежние ссылки сохраняются после перезапуска
+			repo.Close()
+			if name == backend.Memory {
+				return
+			}
+			repo, err = backend.Open(ctx, cfgApp)
+			require.NoError(t, err)
+			defer repo.Close()
+			for _, longURL := range []string{"https://yandex.ru/again", "https://yandex.ru/reaped"} {
+				e, err = repo.SelectByLongURL(ctx, longURL)
+				require.NoError(t, err)
+				require.False(t, e.Deleted, longURL)
+			}
+			for _, id := range []string{"expired", "reaped", "aliased", strings.TrimPrefix(shortURL, *BaseURL+"/")} {
+				e, err = repo.SelectByShortID(ctx, id)
+				require.NoError(t, err)
+				require.True(t, e.Deleted || e.Expired(time.Now()), id)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"github.com/antonevtu/go_shortener_adv/internal/cfg"
+	"github.com/antonevtu/go_shortener_adv/internal/db"
+	"github.com/antonevtu/go_shortener_adv/internal/handlers"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDBMigrations(t *testing.T) {
+	// БД в контейнере
+	var dbPool db.T
+	ctx := context.Background()
+	container, db1, err := createTestContainer(ctx, "pg")
+	require.NoError(t, err)
+	defer db1.Close()
+	defer container.Terminate(ctx)
+	dbPool.Pool = db1
+
+	latest, err := db.LatestVersion()
+	require.NoError(t, err)
+
+	// таблица, созданная до появления миграций
+	_, err = dbPool.Exec(ctx, "create table urls (id serial primary key, deleted boolean not null, "+
+		"user_id varchar(512) not null, short_id varchar(512) not null unique, long_url varchar(1024) not null unique)")
+	require.NoError(t, err)
+
+	// конкурентные экземпляры сериализуются advisory lock
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = dbPool.MigrateUp(ctx)
+		}(i)
+	}
+	wg.Wait()
+	for _, err = range errs {
+		require.NoError(t, err)
+	}
+	version, err := dbPool.SchemaVersion(ctx)
+	require.NoError(t, err)
+	require.Equal(t, latest, version)
+
+	// откат и повторное применение
+	err = dbPool.MigrateTo(ctx, 0)
+	require.NoError(t, err)
+	version, err = dbPool.SchemaVersion(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, version)
+	err = dbPool.MigrateUp(ctx)
+	require.NoError(t, err)
+	version, err = dbPool.SchemaVersion(ctx)
+	require.NoError(t, err)
+	require.Equal(t, latest, version)
+}
+
+func TestDBLongURL(t *testing.T) {
+	cfgApp := cfg.Config{
+		ServerAddress:   *ServerAddress,
+		BaseURL:         *BaseURL,
+		FileStoragePath: *FileStoragePath,
+		DatabaseDSN:     *DatabaseDSN,
+		CtxTimeout:      *CtxTimeout,
+	}
+
+	// БД в контейнере
+	var dbPool db.T
+	ctx := context.Background()
+	container, db1, err := createTestContainer(ctx, "pg")
+	require.NoError(t, err)
+	defer db1.Close()
+	defer container.Terminate(ctx)
+	dbPool.Pool = db1
+	err = dbPool.MigrateUp(ctx)
+	require.NoError(t, err)
+
+	ts := httptest.NewServer(handlers.NewRouter(&dbPool, cfgApp))
+	defer ts.Close()
+
+	// URL длиннее прежнего ограничения varchar(1024)
+	longURL := "https://yandex.ru/?utm=" + strings.Repeat("x", 10000)
+	resp, shortURL1 := testRequest(t, ts.URL, http.MethodPost, bytes.NewBufferString(longURL))
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp, shortURL2 := testRequest(t, ts.URL, http.MethodPost, bytes.NewBufferString(longURL))
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+	require.Equal(t, shortURL1, shortURL2)
+
+	u, err := url.Parse(shortURL1)
+	require.NoError(t, err)
+	resp, _ = testRequest(t, ts.URL+u.Path, http.MethodGet, nil)
+	require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	require.Equal(t, longURL, resp.Header.Get("Location"))
+}
@@ -0,0 +1,170 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/antonevtu/go_shortener_adv/internal/backend"
+	"github.com/antonevtu/go_shortener_adv/internal/cfg"
+	"github.com/antonevtu/go_shortener_adv/internal/clicks"
+	"github.com/antonevtu/go_shortener_adv/internal/handlers"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClickRollups(t *testing.T) {
+	for _, name := range []string{backend.Memory, backend.File} {
+		t.Run(name, func(t *testing.T) {
+			cfgApp, repo, ts := newTestServer(t, name, func(c *cfg.Config) {
+				c.ClickRetention = 24 * time.Hour
+				c.ClickRollupFrom = 48 * time.Hour
+			})
+			ctx := context.Background()
+
+			resp, shortURL := testGZipRequest(t, ts.URL, http.MethodPost, bytes.NewBufferString("https://yandex.ru/rollups"))
+			require.Equal(t, http.StatusCreated, resp.StatusCode)
+			cookies := resp.Cookies()
+			shortID := strings.TrimPrefix(shortURL, *BaseURL+"/")
+
+			// переходы десять дней назад и сейчас
+			now := time.Now().UTC()
+			old := now.Add(-10 * 24 * time.Hour)
+			batch := []clicks.Click{
+				clicks.NewClick(shortID, "https://google.com/", "curl/7.79.1", old),
+				clicks.NewClick(shortID, "https://google.com/", "curl/7.79.1", old.Add(time.Minute)),
+				clicks.NewClick(shortID, "", "Googlebot/2.1", old.Add(time.Hour)),
+				clicks.NewClick(shortID, "", "curl/7.79.1", now),
+			}
+			store := repo.(clicks.Store)
+			require.NoError(t, store.AddClicks(ctx, batch))
+
+			getStats := func(path string) statsResponse {
+				req, err := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+				require.NoError(t, err)
+				for _, c := range cookies {
+					req.AddCookie(c)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				require.NoError(t, err)
+				defer resp.Body.Close()
+				body, err := ioutil.ReadAll(resp.Body)
+				require.NoError(t, err)
+				require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+				var stats statsResponse
+				require.NoError(t, json.Unmarshal(body, &stats))
+				return stats
+			}
+
+			// длинный период читается из суточных агрегатов по целым суткам
+			stats := getStats("/api/user/urls/" + shortID + "/stats")
+			require.Equal(t, clicks.SourceRollup, stats.Source)
+			require.Equal(t, stats.From, stats.From.Truncate(24*time.Hour))
+			require.Equal(t, stats.To, stats.To.Truncate(24*time.Hour))
+			require.Equal(t, int64(4), stats.Total)
+			require.Equal(t, map[string]int64{"google.com": 2, clicks.DirectReferrer: 2}, stats.Referrers)
+
+			// короткий свежий период читается из сырых кликов
+			path := "/api/user/urls/" + shortID + "/stats?bucket=hour&from=" + now.Add(-3*time.Hour).Format(time.RFC3339)
+			stats = getStats(path)
+			require.Equal(t, clicks.SourceRaw, stats.Source)
+			require.Equal(t, map[clicks.AgentClass]int64{clicks.AgentCLI: 1}, stats.Agents)
+
+			// агрегаты совпадают с сырыми кликами на выровненном периоде
+			for _, bucket := range []clicks.Granularity{clicks.Hour, clicks.Day} {
+				q := clicks.Query{ShortID: shortID, From: old.Add(-time.Hour), To: now.Add(time.Hour), Bucket: bucket}.Aligned()
+				raw, err := store.ClickStats(ctx, q)
+				require.NoError(t, err)
+				q.FromRollups = true
+				rolled, err := store.ClickStats(ctx, q)
+				require.NoError(t, err)
+				require.Equal(t, raw.Buckets, rolled.Buckets)
+				require.Equal(t, raw.Referrers, rolled.Referrers)
+				require.Equal(t, raw.Agents, rolled.Agents)
+			}
+
+			// старые сырые клики удаляются, агрегаты остаются
+			purger := repo.(clicks.Purger)
+			n, err := purger.PurgeClicks(ctx, now.Add(-cfgApp.ClickRetention))
+			require.NoError(t, err)
+			require.Equal(t, int64(3), n)
+			n, err = purger.PurgeClicks(ctx, now.Add(-cfgApp.ClickRetention))
+			require.NoError(t, err)
+			require.Zero(t, n)
+
+			oldRange := clicks.Query{ShortID: shortID, From: old.Add(-24 * time.Hour), To: old.Add(24 * time.Hour), Bucket: clicks.Day}.Aligned()
+			raw, err := store.ClickStats(ctx, oldRange)
+			require.NoError(t, err)
+			require.Empty(t, raw.Referrers)
+			require.Equal(t, int64(4), raw.Total)
+
+			// период удалённых кликов читается из агрегатов
+			stats = getStats("/api/user/urls/" + shortID + "/stats?bucket=hour&from=" + old.Add(-time.Hour).Format(time.RFC3339) +
+				"&to=" + old.Add(2*time.Hour).Format(time.RFC3339))
+			require.Equal(t, clicks.SourceRollup, stats.Source)
+			require.Equal(t, map[clicks.AgentClass]int64{clicks.AgentCLI: 2, clicks.AgentBot: 1}, stats.Agents)
+
+			repo.Close()
+			if name == backend.Memory {
+				return
+			}
+
+			// удаление и агрегаты сохраняются после перезапуска и сжатия файла
+			for _, compact := range []bool{false, true} {
+				repo, err = backend.Open(ctx, cfgApp)
+				require.NoError(t, err)
+				if compact {
+					require.NoError(t, repo.(handlers.Compactor).Compact())
+				}
+				store = repo.(clicks.Store)
+				oldRange.FromRollups = false
+				raw, err = store.ClickStats(ctx, oldRange)
+				require.NoError(t, err)
+				require.Empty(t, raw.Referrers)
+				oldRange.FromRollups = true
+				rolled, err := store.ClickStats(ctx, oldRange)
+				require.NoError(t, err)
+				require.Equal(t, int64(4), rolled.Total)
+				require.Equal(t, map[string]int64{"google.com": 2, clicks.DirectReferrer: 1}, rolled.Referrers)
+				repo.Close()
+			}
+		})
+	}
+}
+
+type countingPurger struct {
+	before chan time.Time
+}
+
+func (p countingPurger) PurgeClicks(_ context.Context, before time.Time) (int64, error) {
+	select {
+	case p.before <- before:
+	default:
+	}
+	return 0, nil
+}
+
+// удаление сырых кликов запускается периодически до остановки
+func TestClickRetention(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	purger := countingPurger{before: make(chan time.Time, 1)}
+	done := clicks.RunRetention(ctx, purger, time.Hour, 10*time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case before := <-purger.before:
+			require.WithinDuration(t, time.Now().Add(-time.Hour), before, time.Second)
+		case <-time.After(time.Second):
+			t.Fatal("retention didn't run")
+		}
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("retention didn't stop")
+	}
+}
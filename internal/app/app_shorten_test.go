@@ -0,0 +1,103 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/antonevtu/go_shortener_adv/internal/cfg"
+	"github.com/antonevtu/go_shortener_adv/internal/db"
+	"github.com/antonevtu/go_shortener_adv/internal/handlers"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// одновременное сокращение одного URL: ровно один ответ 201, остальные 409 с тем же коротким URL
+func TestConcurrentShorten(t *testing.T) {
+	for _, name := range testBackends {
+		t.Run(name, func(t *testing.T) {
+			_, repo, ts := newTestServer(t, name, nil)
+			defer repo.Close()
+
+			const n = 20
+			longURL := "https://yandex.ru/maps/geo/sochi/53166566/"
+			codes := make([]int, n)
+			shortURLs := make([]string, n)
+			var wg sync.WaitGroup
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					resp, err := http.Post(ts.URL, "text/plain", bytes.NewBufferString(longURL))
+					if err != nil {
+						return
+					}
+					defer resp.Body.Close()
+					var buf bytes.Buffer
+					_, _ = buf.ReadFrom(resp.Body)
+					codes[i], shortURLs[i] = resp.StatusCode, buf.String()
+				}(i)
+			}
+			wg.Wait()
+
+			created := 0
+			for i := 0; i < n; i++ {
+				if codes[i] == http.StatusCreated {
+					created++
+				} else {
+					require.Equal(t, http.StatusConflict, codes[i])
+				}
+				require.Equal(t, shortURLs[0], shortURLs[i])
+			}
+			require.Equal(t, 1, created)
+		})
+	}
+}
+
+func TestDBBatchStatus(t *testing.T) {
+	cfgApp := cfg.Config{
+		ServerAddress: *ServerAddress,
+		BaseURL:       *BaseURL,
+		DatabaseDSN:   *DatabaseDSN,
+		CtxTimeout:    *CtxTimeout,
+	}
+
+	// БД в контейнере
+	var dbPool db.T
+	ctx := context.Background()
+	container, db1, err := createTestContainer(ctx, "pg")
+	require.NoError(t, err)
+	defer db1.Close()
+	defer container.Terminate(ctx)
+	dbPool.Pool = db1
+	err = dbPool.MigrateUp(ctx)
+	require.NoError(t, err)
+
+	ts := httptest.NewServer(handlers.NewRouter(&dbPool, cfgApp))
+	defer ts.Close()
+
+	resp, shortURL := testRequest(t, ts.URL, http.MethodPost, bytes.NewBufferString("https://yandex.ru/0"))
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	batch := batchInput{
+		{CorrelationID: "0", OriginalURL: "https://yandex.ru/0"},
+		{CorrelationID: "1", OriginalURL: "https://yandex.ru/1"},
+		{CorrelationID: "2", OriginalURL: "https://yandex.ru/1"},
+		{CorrelationID: "3", OriginalURL: ""},
+	}
+	jsonBatch, err := json.Marshal(batch)
+	require.NoError(t, err)
+	resp, body := testRequest(t, ts.URL+"/api/shorten/batch", http.MethodPost, bytes.NewBuffer(jsonBatch))
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var batchOut batchOutput
+	err = json.Unmarshal([]byte(body), &batchOut)
+	require.NoError(t, err)
+	require.Equal(t, batchOutput{
+		{CorrelationID: "0", ShortURL: shortURL, Status: "exists"},
+		{CorrelationID: "1", ShortURL: batchOut[1].ShortURL, Status: "created"},
+		{CorrelationID: "2", ShortURL: batchOut[1].ShortURL, Status: "exists"},
+		{CorrelationID: "3", Status: "invalid"},
+	}, batchOut)
+}
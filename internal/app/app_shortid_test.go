@@ -0,0 +1,148 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/antonevtu/go_shortener_adv/internal/backend"
+	"github.com/antonevtu/go_shortener_adv/internal/cfg"
+	"github.com/antonevtu/go_shortener_adv/internal/db"
+	"github.com/antonevtu/go_shortener_adv/internal/handlers"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestShortIDStrategies(t *testing.T) {
+	for _, strategy := range []string{"", cfg.ShortIDRandom, cfg.ShortIDCounter, cfg.ShortIDHash} {
+		t.Run("strategy_"+strategy, func(t *testing.T) {
+			cfgApp := cfg.Config{
+				ServerAddress:   *ServerAddress,
+				BaseURL:         *BaseURL,
+				StorageBackend:  backend.Memory,
+				CtxTimeout:      *CtxTimeout,
+				ShortIDStrategy: strategy,
+			}
+			repo, err := backend.Open(context.Background(), cfgApp)
+			require.NoError(t, err)
+			defer repo.Close()
+			ts := httptest.NewServer(handlers.NewRouter(repo, cfgApp))
+			defer ts.Close()
+
+			// по умолчанию 8 символов base62
+			resp, shortURL := testRequest(t, ts.URL, http.MethodPost, bytes.NewBufferString("https://yandex.ru/a"))
+			require.Equal(t, http.StatusCreated, resp.StatusCode)
+			shortID := strings.TrimPrefix(shortURL, *BaseURL+"/")
+			require.Regexp(t, regexp.MustCompile("^[0-9A-Za-z]{8}$"), shortID)
+
+			// короткий URL раскрывается
+			resp, _ = testRequest(t, ts.URL+"/"+shortID, http.MethodGet, nil)
+			require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+			require.Equal(t, "https://yandex.ru/a", resp.Header.Get("Location"))
+
+			// пакет получает уникальные ID той же длины
+			batch := []batchInputItem{{CorrelationID: "0", OriginalURL: "https://yandex.ru/b"}, {CorrelationID: "1", OriginalURL: "https://yandex.ru/c"}}
+			buf, err := json.Marshal(batch)
+			require.NoError(t, err)
+			resp, jsonResp := testRequest(t, ts.URL+"/api/shorten/batch", http.MethodPost, bytes.NewBuffer(buf))
+			require.Equal(t, http.StatusCreated, resp.StatusCode)
+			var output []batchOutputItem
+			require.NoError(t, json.Unmarshal([]byte(jsonResp), &output))
+			require.Len(t, output, 2)
+			require.NotEqual(t, output[0].ShortURL, output[1].ShortURL)
+			for _, v := range output {
+				require.Regexp(t, regexp.MustCompile("^[0-9A-Za-z]{8}$"), strings.TrimPrefix(v.ShortURL, *BaseURL+"/"))
+			}
+		})
+	}
+}
+
+// хеш-стратегия детерминирована, а занятый другим URL ID генерируется заново
+func TestShortIDHash(t *testing.T) {
+	cfgApp := cfg.Config{
+		ServerAddress:   *ServerAddress,
+		BaseURL:         *BaseURL,
+		StorageBackend:  backend.SQLite,
+		SQLitePath:      filepath.Join(t.TempDir(), "storage.db"),
+		CtxTimeout:      *CtxTimeout,
+		ShortIDStrategy: cfg.ShortIDHash,
+		ShortIDAlphabet: "abcdef",
+		ShortIDLength:   6,
+	}
+	gen, err := handlers.NewShortIDGenerator(cfgApp)
+	require.NoError(t, err)
+	longURL := "https://yandex.ru/maps/"
+	first, err := gen.NewShortID(longURL, 0)
+	require.NoError(t, err)
+	require.Regexp(t, regexp.MustCompile("^[a-f]{6}$"), first)
+	again, err := gen.NewShortID(longURL, 0)
+	require.NoError(t, err)
+	require.Equal(t, first, again)
+	second, err := gen.NewShortID(longURL, 1)
+	require.NoError(t, err)
+	require.NotEqual(t, first, second)
+
+	repo, err := backend.Open(context.Background(), cfgApp)
+	require.NoError(t, err)
+	defer repo.Close()
+	ts := httptest.NewServer(handlers.NewRouter(repo, cfgApp))
+	defer ts.Close()
+
+	// первый по хешу ID уже занят другим URL
+	_, _, err = repo.AddOrGetEntity(context.Background(), db.Entity{UserID: "other", ShortID: first, LongURL: "https://ya.ru/"})
+	require.NoError(t, err)
+
+	resp, shortURL := testRequest(t, ts.URL, http.MethodPost, bytes.NewBufferString(longURL))
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, *BaseURL+"/"+second, shortURL)
+
+	// то же в пакете
+	batch := []batchInputItem{{CorrelationID: "0", OriginalURL: "https://yandex.ru/batch"}}
+	taken, err := gen.NewShortID(batch[0].OriginalURL, 0)
+	require.NoError(t, err)
+	_, _, err = repo.AddOrGetEntity(context.Background(), db.Entity{UserID: "other", ShortID: taken, LongURL: "https://ya.ru/batch"})
+	require.NoError(t, err)
+	buf, err := json.Marshal(batch)
+	require.NoError(t, err)
+	resp, jsonResp := testRequest(t, ts.URL+"/api/shorten/batch", http.MethodPost, bytes.NewBuffer(buf))
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var output []batchOutputItem
+	require.NoError(t, json.Unmarshal([]byte(jsonResp), &output))
+	require.Len(t, output, 1)
+	require.Equal(t, "created", output[0].Status)
+	require.NotEqual(t, *BaseURL+"/"+taken, output[0].ShortURL)
+
+	// все попытки генерации заняты: ошибка сервера, а не занятый псевдоним
+	exhausted := "https://yandex.ru/exhausted"
+	for attempt := 0; attempt < 5; attempt++ {
+		id, err := gen.NewShortID(exhausted, attempt)
+		require.NoError(t, err)
+		_, _, err = repo.AddOrGetEntity(context.Background(), db.Entity{UserID: "other", ShortID: id, LongURL: exhausted + "/" + id})
+		require.NoError(t, err)
+	}
+	resp, body := testRequest(t, ts.URL+"/api/shorten", http.MethodPost, bytes.NewBufferString(`{"url":"`+exhausted+`"}`))
+	require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	require.Contains(t, body, "no free short ID")
+	require.NotContains(t, body, "alias")
+}
+
+func TestShortIDConfig(t *testing.T) {
+	require.NoError(t, cfg.ValidateShortID(cfg.ShortIDRandom, cfg.DefaultShortIDAlphabet, cfg.DefaultShortIDLength))
+	require.NoError(t, cfg.ValidateShortID(cfg.ShortIDUUID, "", 0))
+	require.Error(t, cfg.ValidateShortID("sequence", cfg.DefaultShortIDAlphabet, 8))
+	require.Error(t, cfg.ValidateShortID(cfg.ShortIDRandom, "a", 8))
+	require.Error(t, cfg.ValidateShortID(cfg.ShortIDRandom, "aab", 8))
+	require.Error(t, cfg.ValidateShortID(cfg.ShortIDRandom, "ab/", 8))
+	require.Error(t, cfg.ValidateShortID(cfg.ShortIDCounter, "ab", -1))
+
+	// счётчик от текущего времени в миллисекундах не помещается в 6 символов из 6
+	require.NoError(t, cfg.ValidateShortID(cfg.ShortIDCounter, cfg.DefaultShortIDAlphabet, cfg.DefaultShortIDLength))
+	require.Error(t, cfg.ValidateShortID(cfg.ShortIDCounter, "abcdef", 6))
+	require.NoError(t, cfg.ValidateShortID(cfg.ShortIDRandom, "abcdef", 6))
+	require.True(t, cfg.CounterFits(35, 6, 2))
+	require.False(t, cfg.CounterFits(36, 6, 2))
+}
@@ -0,0 +1,150 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/antonevtu/go_shortener_adv/internal/backend"
+	"github.com/antonevtu/go_shortener_adv/internal/cfg"
+	"github.com/antonevtu/go_shortener_adv/internal/clicks"
+	"github.com/antonevtu/go_shortener_adv/internal/db"
+	"github.com/antonevtu/go_shortener_adv/internal/handlers"
+	"github.com/antonevtu/go_shortener_adv/internal/pool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSQLite(t *testing.T) {
+	cfgApp := cfg.Config{
+		ServerAddress:  *ServerAddress,
+		BaseURL:        *BaseURL,
+		StorageBackend: backend.SQLite,
+		SQLitePath:     filepath.Join(t.TempDir(), "storage.db"),
+		CtxTimeout:     *CtxTimeout,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	repo, err := backend.Open(ctx, cfgApp)
+	require.NoError(t, err)
+	defer repo.Close()
+	journal, ok := repo.(pool.Journal)
+	require.True(t, ok)
+	deleterPool := pool.New(ctx, repo, pool.WithJournal(journal))
+	cfgApp.DeleterPool = &deleterPool
+	ts := httptest.NewServer(handlers.NewRouter(repo, cfgApp))
+	defer ts.Close()
+
+	resp, _ := testRequest(t, ts.URL+"/ping", http.MethodGet, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// сокращение и конфликт
+	longURL := "https://yandex.ru/sqlite"
+	resp, shortURLInJSON := testRequest(t, ts.URL+"/api/shorten", http.MethodPost, testEncodeJSONLongURL(longURL))
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	cookies := resp.Cookies()
+	shortURL := testDecodeJSONShortURL(t, shortURLInJSON)
+	resp, shortURLInJSON = testRequest(t, ts.URL+"/api/shorten", http.MethodPost, testEncodeJSONLongURL(longURL))
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+	require.Equal(t, shortURL, testDecodeJSONShortURL(t, shortURLInJSON))
+
+	// пакетное сокращение
+	batch := batchInput{
+		{CorrelationID: "0", OriginalURL: "https://yandex.ru/sqlite/0"},
+		{CorrelationID: "1", OriginalURL: "https://yandex.ru/sqlite/1"},
+	}
+	jsonBatch, err := json.Marshal(batch)
+	require.NoError(t, err)
+	resp, body := testGZipRequestCookie(t, ts.URL+"/api/shorten/batch", http.MethodPost, bytes.NewBuffer(jsonBatch), cookies)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var batchOut batchOutput
+	err = json.Unmarshal([]byte(body), &batchOut)
+	require.NoError(t, err)
+	resp, body = testGZipRequestCookie(t, ts.URL+"/api/shorten/batch", http.MethodPost, bytes.NewBuffer(jsonBatch), cookies)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var repeatOut batchOutput
+	err = json.Unmarshal([]byte(body), &repeatOut)
+	require.NoError(t, err)
+	for i := range batchOut {
+		require.Equal(t, "created", batchOut[i].Status)
+		require.Equal(t, "exists", repeatOut[i].Status)
+		require.Equal(t, batchOut[i].ShortURL, repeatOut[i].ShortURL)
+	}
+
+	// история пользователя
+	resp, body = testGZipRequestCookie(t, ts.URL+"/api/user/urls", http.MethodGet, bytes.NewBufferString(""), cookies)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var history []struct {
+		ShortURL    string `json:"short_url"`
+		OriginalURL string `json:"original_url"`
+	}
+	err = json.Unmarshal([]byte(body), &history)
+	require.NoError(t, err)
+	require.Len(t, history, 3)
+
+	// удаление
+	u, err := url.Parse(shortURL)
+	require.NoError(t, err)
+	resp, _ = testGZipRequestCookie(t, ts.URL+"/api/user/urls", http.MethodDelete, testEncodeJSONDeleteList(shortIDList{u.Path[1:]}), cookies)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	require.Eventually(t, func() bool {
+		resp, _ := testRequest(t, ts.URL+u.Path, http.MethodGet, nil)
+		return resp.StatusCode == http.StatusGone
+	}, time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		pending, err := journal.PendingDeletes(ctx)
+		return err == nil && len(pending) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+// база, созданная до появления миграций, получает версию по уже добавленным колонкам и обновляется
+func TestSQLiteLegacyMigration(t *testing.T) {
+	for name, schema := range map[string][]string{
+		"without_expires_at": {
+			"create table urls (id integer primary key autoincrement, deleted boolean not null, user_id text not null, " +
+				"short_id text not null unique, long_url text not null unique)",
+			"create table delete_queue (id integer primary key autoincrement, user_id text not null, short_id text not null)",
+		},
+		"with_expires_at": {
+			"create table urls (id integer primary key autoincrement, deleted boolean not null, user_id text not null, " +
+				"short_id text not null unique, long_url text not null unique, expires_at integer)",
+			"create table delete_queue (id integer primary key autoincrement, user_id text not null, short_id text not null)",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "storage.db")
+			legacy, err := sql.Open("sqlite", path)
+			require.NoError(t, err)
+			for _, query := range append(schema, "insert into urls (deleted, user_id, short_id, long_url) values (false, 'u', 'old', 'https://yandex.ru/old')") {
+				_, err = legacy.Exec(query)
+				require.NoError(t, err)
+			}
+			require.NoError(t, legacy.Close())
+
+			ctx := context.Background()
+			for i := 0; i < 2; i++ { // повторное открытие не применяет миграции заново
+				repo, err := backend.Open(ctx, cfg.Config{StorageBackend: backend.SQLite, SQLitePath: path})
+				require.NoError(t, err)
+				e, err := repo.SelectByShortID(ctx, "old")
+				require.NoError(t, err)
+				require.Equal(t, "https://yandex.ru/old", e.LongURL)
+				expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+				shortID := "new" + strconv.Itoa(i)
+				err = repo.AddEntity(ctx, db.Entity{UserID: "u", ShortID: shortID, LongURL: "https://yandex.ru/" + shortID, ExpiresAt: &expiresAt})
+				require.NoError(t, err)
+				journal := repo.(pool.Journal)
+				require.NoError(t, journal.AppendDeletes(ctx, []pool.ToDeleteItem{{UserID: "u", ShortID: "old", JobID: "job"}}))
+				require.NoError(t, repo.(clicks.Store).AddClicks(ctx, []clicks.Click{{ShortID: "old", Time: time.Now()}}))
+				repo.Close()
+			}
+		})
+	}
+}
@@ -3,11 +3,17 @@ package app
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
+	"github.com/antonevtu/go_shortener_adv/internal/backend"
 	"github.com/antonevtu/go_shortener_adv/internal/cfg"
+	"github.com/antonevtu/go_shortener_adv/internal/db"
 	"github.com/antonevtu/go_shortener_adv/internal/handlers"
+	"github.com/antonevtu/go_shortener_adv/internal/pool"
 	"github.com/antonevtu/go_shortener_adv/internal/repository"
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"io"
@@ -16,7 +22,11 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 )
 
 var (
@@ -71,7 +81,7 @@ func TestGZipJSONAPI(t *testing.T) {
 }
 
 func TestJSONAPI(t *testing.T) {
-	//_ = os.Remove(cfgApp.FileStoragePath)
+	_ = os.Remove(*FileStoragePath)
 	cfgApp := cfg.Config{
 		ServerAddress:   *ServerAddress,
 		BaseURL:         *BaseURL,
@@ -139,7 +149,7 @@ func TestJSONAPI(t *testing.T) {
 }
 
 func TestTextAPI(t *testing.T) {
-	//_ = os.Remove(cfgApp.FileStoragePath)
+	_ = os.Remove(*FileStoragePath)
 	cfgApp := cfg.Config{
 		ServerAddress:   *ServerAddress,
 		BaseURL:         *BaseURL,
@@ -192,6 +202,317 @@ func TestTextAPI(t *testing.T) {
 	defer file.Close()
 }
 
+func TestFileConflict(t *testing.T) {
+	_ = os.Remove(*FileStoragePath)
+	cfgApp := cfg.Config{
+		ServerAddress:   *ServerAddress,
+		BaseURL:         *BaseURL,
+		FileStoragePath: *FileStoragePath,
+		DatabaseDSN:     *DatabaseDSN,
+		CtxTimeout:      *CtxTimeout,
+	}
+
+	repo, err := repository.New(*FileStoragePath)
+	require.NoError(t, err)
+	r := handlers.NewRouter(repo, cfgApp)
+	ts := httptest.NewServer(r)
+
+	// Create ID
+	longURL := "https://yandex.ru/maps/geo/sochi/53166566/?ll=39.580041%2C43.713351&z=9.98"
+	resp, shortURL1 := testRequest(t, ts.URL, "POST", bytes.NewBufferString(longURL))
+	err = resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	// Same long URL in text API returns existing short URL
+	resp, shortURL2 := testRequest(t, ts.URL, "POST", bytes.NewBufferString(longURL))
+	err = resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.Equal(t, shortURL1, shortURL2)
+
+	// Same long URL in JSON API returns existing short URL
+	resp, shortURLInJSON := testRequest(t, ts.URL+"/api/shorten", "POST", testEncodeJSONLongURL(longURL))
+	err = resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.Equal(t, shortURL1, testDecodeJSONShortURL(t, shortURLInJSON))
+	ts.Close()
+	repo.Close()
+
+	// Long URL index is restored from file
+	repo, err = repository.New(*FileStoragePath)
+	require.NoError(t, err)
+	defer repo.Close()
+	ts = httptest.NewServer(handlers.NewRouter(repo, cfgApp))
+	defer ts.Close()
+	resp, shortURL2 = testRequest(t, ts.URL, "POST", bytes.NewBufferString(longURL))
+	err = resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.Equal(t, shortURL1, shortURL2)
+}
+
+func TestFileBatch(t *testing.T) {
+	_ = os.Remove(*FileStoragePath)
+	cfgApp := cfg.Config{
+		ServerAddress:   *ServerAddress,
+		BaseURL:         *BaseURL,
+		FileStoragePath: *FileStoragePath,
+		DatabaseDSN:     *DatabaseDSN,
+		CtxTimeout:      *CtxTimeout,
+	}
+
+	repo, err := repository.New(*FileStoragePath)
+	require.NoError(t, err)
+	ts := httptest.NewServer(handlers.NewRouter(repo, cfgApp))
+
+	batch := batchInput{
+		{CorrelationID: "0", OriginalURL: "https://yandex.ru/0"},
+		{CorrelationID: "1", OriginalURL: "https://yandex.ru/1"},
+	}
+	jsonBatch, err := json.Marshal(batch)
+	require.NoError(t, err)
+	resp, body := testRequest(t, ts.URL+"/api/shorten/batch", "POST", bytes.NewBuffer(jsonBatch))
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var batchOut batchOutput
+	err = json.Unmarshal([]byte(body), &batchOut)
+	require.NoError(t, err)
+	require.Len(t, batchOut, len(batch))
+
+	// Existing, repeated and invalid long URLs are reported per item, new ones are added
+	batch = batchInput{
+		{CorrelationID: "2", OriginalURL: "https://yandex.ru/2"},
+		{CorrelationID: "3", OriginalURL: "https://yandex.ru/1"},
+		{CorrelationID: "4", OriginalURL: "not a url"},
+		{CorrelationID: "5", OriginalURL: "https://yandex.ru/2"},
+	}
+	jsonBatch, err = json.Marshal(batch)
+	require.NoError(t, err)
+	resp, body = testRequest(t, ts.URL+"/api/shorten/batch", "POST", bytes.NewBuffer(jsonBatch))
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var mixedOut batchOutput
+	err = json.Unmarshal([]byte(body), &mixedOut)
+	require.NoError(t, err)
+	require.Len(t, mixedOut, len(batch))
+	assert.Equal(t, batchOutputItem{CorrelationID: "3", ShortURL: batchOut[1].ShortURL, Status: "exists"}, mixedOut[1])
+	assert.Equal(t, batchOutputItem{CorrelationID: "4", Status: "invalid"}, mixedOut[2])
+	assert.Equal(t, batchOutputItem{CorrelationID: "5", ShortURL: mixedOut[0].ShortURL, Status: "exists"}, mixedOut[3])
+	assert.Equal(t, "created", mixedOut[0].Status)
+	resp, shortURL := testRequest(t, ts.URL, "POST", bytes.NewBufferString("https://yandex.ru/2"))
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.Equal(t, mixedOut[0].ShortURL, shortURL)
+	ts.Close()
+	repo.Close()
+
+	// Batch is restored from file
+	repo, err = repository.New(*FileStoragePath)
+	require.NoError(t, err)
+	defer repo.Close()
+	ts = httptest.NewServer(handlers.NewRouter(repo, cfgApp))
+	defer ts.Close()
+	for i, v := range batchOut {
+		u, err := url.Parse(v.ShortURL)
+		require.NoError(t, err)
+		resp, _ = testRequest(t, ts.URL+u.Path, "GET", nil)
+		assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+		assert.Equal(t, "https://yandex.ru/"+strconv.Itoa(i), resp.Header.Get("Location"))
+	}
+}
+
+func TestFileCompact(t *testing.T) {
+	_ = os.Remove(*FileStoragePath)
+	cfgApp := cfg.Config{
+		ServerAddress:   *ServerAddress,
+		BaseURL:         *BaseURL,
+		FileStoragePath: *FileStoragePath,
+		DatabaseDSN:     *DatabaseDSN,
+		CtxTimeout:      *CtxTimeout,
+	}
+
+	repo, err := repository.New(*FileStoragePath, repository.WithCompaction(0, 4))
+	require.NoError(t, err)
+	ts := httptest.NewServer(handlers.NewRouter(repo, cfgApp))
+
+	// 3 records
+	paths := make([]string, 3)
+	var cookies []*http.Cookie
+	for i := range paths {
+		resp, shortURL := testGZipRequestCookie(t, ts.URL, "POST", bytes.NewBufferString("https://yandex.ru/"+strconv.Itoa(i)), cookies)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		cookies = resp.Cookies()
+		u, err := url.Parse(shortURL)
+		require.NoError(t, err)
+		paths[i] = u.Path
+	}
+	userID := testUserID(t, cookies)
+
+	// 4th record (tombstone) triggers background compaction
+	err = repo.SetDeleted(context.Background(), pool.ToDeleteItem{UserID: userID, ShortID: paths[0][1:]})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return testCountLines(t, *FileStoragePath) == len(paths)
+	}, time.Second, 10*time.Millisecond)
+
+	// manual compaction
+	err = repo.SetDeleted(context.Background(), pool.ToDeleteItem{UserID: userID, ShortID: paths[1][1:]})
+	require.NoError(t, err)
+	require.Equal(t, len(paths)+1, testCountLines(t, *FileStoragePath))
+	resp, _ := testRequest(t, ts.URL+"/debug/storage/compact", "POST", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, len(paths), testCountLines(t, *FileStoragePath))
+	ts.Close()
+	repo.Close()
+
+	// snapshot is restored
+	repo, err = repository.New(*FileStoragePath)
+	require.NoError(t, err)
+	defer repo.Close()
+	ts = httptest.NewServer(handlers.NewRouter(repo, cfgApp))
+	defer ts.Close()
+	for i, status := range []int{http.StatusGone, http.StatusGone, http.StatusTemporaryRedirect} {
+		resp, _ = testRequest(t, ts.URL+paths[i], "GET", nil)
+		assert.Equal(t, status, resp.StatusCode)
+	}
+}
+
+// записи, сделанные во время сжатия, не теряются
+func TestFileCompactConcurrent(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "storage.txt")
+	repo, err := repository.New(fileName)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	const writers, perWriter = 4, 50
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				id := strconv.Itoa(w) + "_" + strconv.Itoa(i)
+				err := repo.AddEntity(ctx, db.Entity{UserID: "u", ShortID: id, LongURL: "https://yandex.ru/" + id})
+				assert.NoError(t, err)
+			}
+		}(w)
+	}
+	for done := false; !done; {
+		require.NoError(t, repo.Compact())
+		done = len(testSelectByUser(t, repo, "u")) == writers*perWriter
+	}
+	wg.Wait()
+	require.NoError(t, repo.Compact())
+	require.Equal(t, writers*perWriter, testCountLines(t, fileName))
+	repo.Close()
+
+	repo, err = repository.New(fileName)
+	require.NoError(t, err)
+	defer repo.Close()
+	require.Len(t, testSelectByUser(t, repo, "u"), writers*perWriter)
+}
+
+func testSelectByUser(t *testing.T, repo *repository.Repository, userID string) []db.Entity {
+	entities, err := repo.SelectByUser(context.Background(), userID)
+	require.NoError(t, err)
+	return entities
+}
+
+func TestFileRecovery(t *testing.T) {
+	_ = os.Remove(*FileStoragePath)
+	cfgApp := cfg.Config{
+		ServerAddress:   *ServerAddress,
+		BaseURL:         *BaseURL,
+		FileStoragePath: *FileStoragePath,
+		DatabaseDSN:     *DatabaseDSN,
+		CtxTimeout:      *CtxTimeout,
+	}
+
+	// plain JSON record of older file format
+	legacy := `{"deleted":false,"user_id":"u1","id":"legacy","url":"https://yandex.ru/legacy"}` + "\n"
+	err := os.WriteFile(*FileStoragePath, []byte(legacy), 0644)
+	require.NoError(t, err)
+
+	repo, err := repository.New(*FileStoragePath, repository.WithSync(repository.SyncAlways, 0))
+	require.NoError(t, err)
+	ts := httptest.NewServer(handlers.NewRouter(repo, cfgApp))
+	resp, shortURL := testRequest(t, ts.URL, "POST", bytes.NewBufferString("https://yandex.ru/new"))
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	u, err := url.Parse(shortURL)
+	require.NoError(t, err)
+	ts.Close()
+	repo.Close()
+	valid, err := os.ReadFile(*FileStoragePath)
+	require.NoError(t, err)
+
+	// torn tail is truncated
+	file, err := os.OpenFile(*FileStoragePath, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"v":1,"crc":1,"rec":{"deleted":fal`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	repo, err = repository.New(*FileStoragePath)
+	require.NoError(t, err)
+	ts = httptest.NewServer(handlers.NewRouter(repo, cfgApp))
+	for _, path := range []string{"/legacy", u.Path} {
+		resp, _ = testRequest(t, ts.URL+path, "GET", nil)
+		assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	}
+	ts.Close()
+	repo.Close()
+	data, err := os.ReadFile(*FileStoragePath)
+	require.NoError(t, err)
+	assert.Equal(t, valid, data)
+
+	// corrupted record in the middle is an error
+	corrupted := bytes.Replace(valid, []byte("yandex.ru/new"), []byte("yandex.ru/bad"), 1)
+	err = os.WriteFile(*FileStoragePath, append(corrupted, legacy...), 0644)
+	require.NoError(t, err)
+	_, err = repository.New(*FileStoragePath)
+	assert.Error(t, err)
+}
+
+func TestMemoryMode(t *testing.T) {
+	_ = os.Remove(*FileStoragePath)
+	cfgApp := cfg.Config{
+		ServerAddress: *ServerAddress,
+		BaseURL:       *BaseURL,
+		CtxTimeout:    *CtxTimeout,
+	}
+
+	repo, err := repository.New("")
+	require.NoError(t, err)
+	defer repo.Close()
+	ts := httptest.NewServer(handlers.NewRouter(repo, cfgApp))
+	defer ts.Close()
+
+	longURL := "https://yandex.ru/memory"
+	resp, shortURL1 := testRequest(t, ts.URL, "POST", bytes.NewBufferString(longURL))
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp, shortURL2 := testRequest(t, ts.URL, "POST", bytes.NewBufferString(longURL))
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+	require.Equal(t, shortURL1, shortURL2)
+
+	u, err := url.Parse(shortURL1)
+	require.NoError(t, err)
+	resp, _ = testRequest(t, ts.URL+u.Path, "GET", nil)
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.Equal(t, longURL, resp.Header.Get("Location"))
+
+	batch := batchInput{{CorrelationID: "0", OriginalURL: "https://yandex.ru/memory/0"}}
+	jsonBatch, err := json.Marshal(batch)
+	require.NoError(t, err)
+	resp, _ = testRequest(t, ts.URL+"/api/shorten/batch", "POST", bytes.NewBuffer(jsonBatch))
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp, _ = testRequest(t, ts.URL+"/debug/storage/compact", "POST", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// nothing is written to disk
+	_, err = os.Stat(*FileStoragePath)
+	assert.True(t, os.IsNotExist(err))
+}
+
 func testGZipRequest(t *testing.T, url, method string, body io.Reader) (*http.Response, string) {
 	client := &http.Client{}
 	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
@@ -265,3 +586,49 @@ func testDecodeJSONShortURL(t *testing.T, js string) string {
 	require.NoError(t, err)
 	return url_.Result
 }
+
+func testCountLines(t *testing.T, fileName string) int {
+	data, err := os.ReadFile(fileName)
+	require.NoError(t, err)
+	return bytes.Count(data, []byte("\n"))
+}
+
+func testUserID(t *testing.T, cookies []*http.Cookie) string {
+	require.NotEmpty(t, cookies)
+	data, err := hex.DecodeString(cookies[0].Value)
+	require.NoError(t, err)
+	userID, err := uuid.FromBytes(data[:16])
+	require.NoError(t, err)
+	return userID.String()
+}
+
+//testBackends are storage backends, which run without external services
+var testBackends = []string{backend.Memory, backend.File, backend.SQLite}
+
+//newTestServer opens repository of backend in temporary directory and serves router over it.
+//mutate, if not nil, changes config before repository is opened.
+//Server is closed on test cleanup, repository is closed by test, as it may be reopened
+func newTestServer(t *testing.T, backendName string, mutate func(*cfg.Config)) (cfg.Config, backend.Repository, *httptest.Server) {
+	cfgApp := newTestConfig(t, backendName)
+	if mutate != nil {
+		mutate(&cfgApp)
+	}
+	repo, err := backend.Open(context.Background(), cfgApp)
+	require.NoError(t, err)
+	ts := httptest.NewServer(handlers.NewRouter(repo, cfgApp))
+	t.Cleanup(ts.Close)
+	return cfgApp, repo, ts
+}
+
+func newTestConfig(t *testing.T, backendName string) cfg.Config {
+	dir := t.TempDir()
+	return cfg.Config{
+		ServerAddress:   *ServerAddress,
+		BaseURL:         *BaseURL,
+		StorageBackend:  backendName,
+		FileStoragePath: filepath.Join(dir, "storage.txt"),
+		SQLitePath:      filepath.Join(dir, "storage.db"),
+		FileSync:        "never",
+		CtxTimeout:      *CtxTimeout,
+	}
+}
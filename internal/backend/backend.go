@@ -0,0 +1,137 @@
+//Package backend builds storage for handlers.Repositorier by backend name.
+//Backends are registered as factory functions, so new storages are plugged in without changes in app.
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/antonevtu/go_shortener_adv/internal/cfg"
+	"github.com/antonevtu/go_shortener_adv/internal/db"
+	"github.com/antonevtu/go_shortener_adv/internal/handlers"
+	"github.com/antonevtu/go_shortener_adv/internal/pool"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//Built-in backend names
+const (
+	Memory   = "memory"
+	File     = "file"
+	Postgres = "postgres"
+	SQLite   = "sqlite"
+)
+
+//Repository is storage backend, which must be closed on shutdown
+type Repository interface {
+	handlers.Repositorier
+	Close()
+}
+
+//Factory builds Repository from config. Factory must return error if config is not enough for backend
+type Factory func(ctx context.Context, cfgApp cfg.Config) (Repository, error)
+
+var (
+	factories     = make(map[string]Factory)
+	factoriesLock sync.RWMutex
+)
+
+//Register makes backend available by name. Panics if name is empty or already registered
+func Register(name string, factory Factory) {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+	if name == "" || factory == nil {
+		panic("backend: Register with empty name or nil factory")
+	}
+	if _, ok := factories[name]; ok {
+		panic("backend: Register called twice for " + name)
+	}
+	factories[name] = factory
+}
+
+//Names returns sorted names of registered backends
+func Names() []string {
+	factoriesLock.RLock()
+	defer factoriesLock.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//Name returns backend name from config.
+//If backend is not set explicitly, it is inferred as before: postgres with DSN, file with storage path, else memory
+func Name(cfgApp cfg.Config) string {
+	switch {
+	case cfgApp.StorageBackend != "":
+		return cfgApp.StorageBackend
+	case cfgApp.DatabaseDSN != "":
+		return Postgres
+	case cfgApp.FileStoragePath != "":
+		return File
+	default:
+		return Memory
+	}
+}
+
+//InferredFrom returns settings, which backend name is inferred from, or empty string if backend is set explicitly
+func InferredFrom(cfgApp cfg.Config) string {
+	switch {
+	case cfgApp.StorageBackend != "":
+		return ""
+	case cfgApp.DatabaseDSN != "":
+		return "DATABASE_DSN (-d)"
+	case cfgApp.FileStoragePath != "":
+		return "FILE_STORAGE_PATH (-f)"
+	default:
+		return "empty DATABASE_DSN (-d) and FILE_STORAGE_PATH (-f)"
+	}
+}
+
+//Validate rejects settings, which contradict explicitly selected backend.
+//Database DSN is used by postgres backend only, so with other backend it is a mistake rather than unused setting.
+//Storage paths have defaults, so they are not checked
+func Validate(cfgApp cfg.Config) error {
+	name := Name(cfgApp)
+	if cfgApp.DatabaseDSN != "" && name != Postgres {
+		return fmt.Errorf("database DSN (DATABASE_DSN or -d) is set, but storage backend is %q", name)
+	}
+	return nil
+}
+
+//Open builds Repository of backend, selected by config
+func Open(ctx context.Context, cfgApp cfg.Config) (Repository, error) {
+	if err := Validate(cfgApp); err != nil {
+		return nil, err
+	}
+	name := Name(cfgApp)
+	factoriesLock.RLock()
+	factory, ok := factories[name]
+	factoriesLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown storage backend %q, available: %s", name, strings.Join(Names(), ", "))
+	}
+
+	repo, err := factory(ctx, cfgApp)
+	if err != nil {
+		return nil, fmt.Errorf("storage backend %q: %w", name, err)
+	}
+	return repo, nil
+}
+
+//OwnerLookup returns lookup of short ID owners in repository for deleter pool job outcomes
+func OwnerLookup(repo handlers.Repositorier) pool.OwnerLookup {
+	return func(ctx context.Context, shortID string) (string, bool, error) {
+		entity, err := repo.SelectByShortID(ctx, shortID)
+		if errors.Is(err, db.ErrNotFound) {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, err
+		}
+		return entity.UserID, true, nil
+	}
+}
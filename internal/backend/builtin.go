@@ -0,0 +1,61 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"github.com/antonevtu/go_shortener_adv/internal/cfg"
+	"github.com/antonevtu/go_shortener_adv/internal/db"
+	"github.com/antonevtu/go_shortener_adv/internal/repository"
+	"github.com/antonevtu/go_shortener_adv/internal/sqlite"
+)
+
+func init() {
+	Register(Memory, newMemory)
+	Register(File, newFile)
+	Register(Postgres, newPostgres)
+	Register(SQLite, newSQLite)
+}
+
+//newMemory returns ephemeral map-only repository
+func newMemory(_ context.Context, _ cfg.Config) (Repository, error) {
+	return repository.New("")
+}
+
+//newFile returns map repository with backup in cfgApp.FileStoragePath
+func newFile(_ context.Context, cfgApp cfg.Config) (Repository, error) {
+	if cfgApp.FileStoragePath == "" {
+		return nil, errors.New("file storage path is not set (FILE_STORAGE_PATH or -f)")
+	}
+	return repository.New(cfgApp.FileStoragePath,
+		repository.WithCompaction(cfgApp.CompactBytes, cfgApp.CompactRecords),
+		repository.WithSync(repository.SyncPolicy(cfgApp.FileSync), cfgApp.FileSyncPeriod))
+}
+
+//newPostgres returns repository in Postgres database cfgApp.DatabaseDSN.
+//Migrations are applied at startup if cfgApp.DBMigrate is set, otherwise cmd/migrate is used
+func newPostgres(ctx context.Context, cfgApp cfg.Config) (Repository, error) {
+	if cfgApp.DatabaseDSN == "" {
+		return nil, errors.New("database DSN is not set (DATABASE_DSN or -d)")
+	}
+	connect := db.Connect
+	if cfgApp.DBMigrate {
+		connect = db.New
+	}
+	dbPool, err := connect(ctx, cfgApp.DatabaseDSN)
+	if err != nil {
+		return nil, err
+	}
+	return &dbPool, nil
+}
+
+//newSQLite returns repository in embedded SQLite database file cfgApp.SQLitePath
+func newSQLite(ctx context.Context, cfgApp cfg.Config) (Repository, error) {
+	if cfgApp.SQLitePath == "" {
+		return nil, errors.New("sqlite database path is not set (SQLITE_PATH)")
+	}
+	sqliteDB, err := sqlite.New(ctx, cfgApp.SQLitePath)
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteDB, nil
+}
@@ -5,18 +5,49 @@ package cfg
 import (
 	"flag"
 	"fmt"
+	"github.com/antonevtu/go_shortener_adv/internal/clicks"
 	"github.com/antonevtu/go_shortener_adv/internal/pool"
 	"github.com/caarlos0/env/v6"
 	"strconv"
+	"time"
 )
 
 type Config struct {
-	ServerAddress   string `env:"SERVER_ADDRESS" envDefault:":8080"`
-	BaseURL         string `env:"BASE_URL" envDefault:"http://localhost:8080"`
-	FileStoragePath string `env:"FILE_STORAGE_PATH" envDefault:"./storage.txt"`
-	DatabaseDSN     string `env:"DATABASE_DSN"`
-	CtxTimeout      int64  `env:"CTX_TIMEOUT" envDefault:"500"`
-	DeleterChan     chan pool.ToDeleteItem
+	ServerAddress   string        `env:"SERVER_ADDRESS" envDefault:":8080"`
+	BaseURL         string        `env:"BASE_URL" envDefault:"http://localhost:8080"`
+	FileStoragePath string        `env:"FILE_STORAGE_PATH" envDefault:"./storage.txt"`
+	DatabaseDSN     string        `env:"DATABASE_DSN"`
+	DBMigrate       bool          `env:"DB_MIGRATE" envDefault:"true"`
+	StorageBackend  string        `env:"STORAGE_BACKEND"`
+	SQLitePath      string        `env:"SQLITE_PATH" envDefault:"./storage.db"`
+	CtxTimeout      int64         `env:"CTX_TIMEOUT" envDefault:"500"`
+	CompactBytes    int64         `env:"COMPACT_BYTES" envDefault:"67108864"`
+	CompactRecords  int           `env:"COMPACT_RECORDS" envDefault:"100000"`
+	FileSync        string        `env:"FILE_SYNC" envDefault:"interval"`
+	FileSyncPeriod  time.Duration `env:"FILE_SYNC_INTERVAL" envDefault:"1s"`
+	DeleteWorkers   int           `env:"DELETE_WORKERS" envDefault:"4"`
+	DeleteQueueSize int           `env:"DELETE_QUEUE_SIZE" envDefault:"1000"`
+	DeleteMaxIDs    int           `env:"DELETE_MAX_IDS" envDefault:"1000"`
+	DeleteTimeout   time.Duration `env:"DELETE_ENQUEUE_TIMEOUT" envDefault:"1s"`
+	DeleteBatchSize int           `env:"DELETE_BATCH_SIZE" envDefault:"100"`
+	DeleteLatency   time.Duration `env:"DELETE_MAX_LATENCY" envDefault:"100ms"`
+	DeleteRetries   int           `env:"DELETE_RETRIES" envDefault:"5"`
+	DeleteRetryBase time.Duration `env:"DELETE_RETRY_DELAY" envDefault:"100ms"`
+	DeleteRetryMax  time.Duration `env:"DELETE_RETRY_MAX_DELAY" envDefault:"5s"`
+	DeadLetters     int           `env:"DELETE_DEAD_LETTERS" envDefault:"10000"`
+	DeleteJobs      int           `env:"DELETE_JOBS" envDefault:"10000"`
+	ShortIDStrategy string        `env:"SHORT_ID_STRATEGY" envDefault:"random"`
+	ShortIDAlphabet string        `env:"SHORT_ID_ALPHABET"` // DefaultShortIDAlphabet if not set
+	ShortIDLength   int           `env:"SHORT_ID_LENGTH"`   // DefaultShortIDLength if not set
+	ReapInterval    time.Duration `env:"EXPIRED_REAP_INTERVAL" envDefault:"1m"`
+	ClickBuffer     int           `env:"CLICK_BUFFER" envDefault:"10000"`
+	ClickBatchSize  int           `env:"CLICK_BATCH_SIZE" envDefault:"500"`
+	ClickFlush      time.Duration `env:"CLICK_FLUSH_INTERVAL" envDefault:"1s"`
+	ClickRetention  time.Duration `env:"CLICK_RAW_RETENTION" envDefault:"720h"`
+	ClickPurge      time.Duration `env:"CLICK_PURGE_INTERVAL" envDefault:"1h"`
+	ClickRollupFrom time.Duration `env:"CLICK_ROLLUP_RANGE" envDefault:"48h"`
+	DeleterPool     *pool.DeleterPoolT
+	ClickWriter     *clicks.Writer
 }
 
 func New() (Config, error) {
@@ -27,6 +58,12 @@ func New() (Config, error) {
 	if err != nil {
 		return cfg, err
 	}
+	if cfg.ShortIDAlphabet == "" {
+		cfg.ShortIDAlphabet = DefaultShortIDAlphabet
+	}
+	if cfg.ShortIDLength == 0 {
+		cfg.ShortIDLength = DefaultShortIDLength
+	}
 
 	// Если заданы аргументы командной строки - перетираем значения переменных окружения
 	flag.Func("a", "server address for shorten", func(flagValue string) error {
@@ -37,7 +74,7 @@ func New() (Config, error) {
 		cfg.BaseURL = flagValue
 		return nil
 	})
-	flag.Func("f", "path to storage file", func(flagValue string) error {
+	flag.Func("f", "path to storage file, empty for in-memory storage without file", func(flagValue string) error {
 		cfg.FileStoragePath = flagValue
 		return nil
 	})
@@ -45,6 +82,10 @@ func New() (Config, error) {
 		cfg.DatabaseDSN = flagValue
 		return nil
 	})
+	flag.Func("s", "storage backend: memory, file, postgres, sqlite; inferred from -d and -f if not set", func(flagValue string) error {
+		cfg.StorageBackend = flagValue
+		return nil
+	})
 	flag.Func("t", "context timeout", func(flagValue string) error {
 		t, err := strconv.Atoi(flagValue)
 		if err != nil {
@@ -56,5 +97,64 @@ func New() (Config, error) {
 
 	flag.Parse()
 
+	err = ValidateShortID(cfg.ShortIDStrategy, cfg.ShortIDAlphabet, cfg.ShortIDLength)
 	return cfg, err
 }
+
+//Strategies of short ID generation
+const (
+	ShortIDRandom  = "random"  // random symbols of alphabet, regenerated on collision
+	ShortIDCounter = "counter" // increasing counter, encoded in alphabet
+	ShortIDHash    = "hash"    // hash of long URL, encoded in alphabet
+	ShortIDUUID    = "uuid"    // UUID, alphabet and length are ignored
+)
+
+//Defaults of short ID generation: 8 symbols of base62
+const (
+	DefaultShortIDAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	DefaultShortIDLength   = 8
+)
+
+//ValidateShortID checks settings of short ID generation. Empty strategy means random.
+//Alphabet must have at least 2 unique ASCII symbols, which are safe in URL path.
+//Length is exact: counter, which starts from current Unix time in milliseconds, must fit in length symbols
+func ValidateShortID(strategy, alphabet string, length int) error {
+	switch strategy {
+	case "", ShortIDRandom, ShortIDCounter, ShortIDHash, ShortIDUUID:
+	default:
+		return fmt.Errorf("unknown short ID strategy %q", strategy)
+	}
+	if strategy == ShortIDUUID {
+		return nil
+	}
+	if length <= 0 {
+		return fmt.Errorf("short ID length must be positive, got %d", length)
+	}
+	if len(alphabet) < 2 {
+		return fmt.Errorf("short ID alphabet must have at least 2 symbols, got %q", alphabet)
+	}
+	seen := make(map[rune]bool, len(alphabet))
+	for _, r := range alphabet {
+		urlSafe := r >= '0' && r <= '9' || r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r == '-' || r == '_' || r == '.' || r == '~'
+		if !urlSafe {
+			return fmt.Errorf("short ID alphabet has symbol %q, not safe in URL path", r)
+		}
+		if seen[r] {
+			return fmt.Errorf("short ID alphabet has repeated symbol %q", r)
+		}
+		seen[r] = true
+	}
+	if strategy == ShortIDCounter && !CounterFits(uint64(time.Now().UnixNano()/int64(time.Millisecond)), len(alphabet), length) {
+		return fmt.Errorf("short ID counter, started from current Unix time in milliseconds, doesn't fit in %d symbols of %d-symbol alphabet",
+			length, len(alphabet))
+	}
+	return nil
+}
+
+//CounterFits reports if n is written in at most length digits of positional system with base
+func CounterFits(n uint64, base, length int) bool {
+	for i := 0; i < length && n > 0; i++ {
+		n /= uint64(base)
+	}
+	return n == 0
+}
@@ -0,0 +1,209 @@
+//Package clicks collects redirects of short links and builds per-link statistics.
+//Redirect handler records clicks to buffered Writer, which flushes them in batches to Store
+//in background, so redirects don't wait for storage.
+//Stores keep hourly and daily rollups besides raw clicks, so statistics of long ranges
+//are read from rollups, and raw clicks may be purged by retention
+package clicks
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//Click is one redirect of short link
+type Click struct {
+	ShortID  string     `json:"short_id"`
+	Time     time.Time  `json:"time"`
+	Referrer string     `json:"referrer"`
+	Agent    AgentClass `json:"agent"`
+}
+
+//AgentClass is coarse class of User-Agent
+type AgentClass string
+
+const (
+	AgentBrowser AgentClass = "browser"
+	AgentMobile  AgentClass = "mobile"
+	AgentBot     AgentClass = "bot"
+	AgentCLI     AgentClass = "cli" // curl, wget and http libraries
+	AgentOther   AgentClass = "other"
+)
+
+//DirectReferrer is referrer of clicks without Referer header
+const DirectReferrer = "(direct)"
+
+//Store is storage of clicks
+type Store interface {
+	//AddClicks stores batch of clicks. Slice is reused by caller and must not be retained
+	AddClicks(ctx context.Context, clicks []Click) error
+
+	//ClickStats returns statistics of one short link.
+	//Store with rollups reads them, if q.FromRollups is set, and counts Total by rollups
+	ClickStats(ctx context.Context, q Query) (Stats, error)
+}
+
+//NewClick returns click of short link at now with classified referrer and User-Agent
+func NewClick(shortID, referer, userAgent string, now time.Time) Click {
+	return Click{ShortID: shortID, Time: now.UTC(), Referrer: ReferrerHost(referer), Agent: ClassifyAgent(userAgent)}
+}
+
+//ReferrerHost returns host of Referer header without "www." prefix, or DirectReferrer
+func ReferrerHost(referer string) string {
+	u, err := url.Parse(referer)
+	if err != nil || u.Hostname() == "" {
+		return DirectReferrer
+	}
+	return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+}
+
+var (
+	botMarkers    = []string{"bot", "crawler", "spider", "slurp", "preview", "facebookexternalhit"}
+	cliMarkers    = []string{"curl", "wget", "httpie", "python-requests", "go-http-client", "okhttp", "java/", "libwww"}
+	mobileMarkers = []string{"mobile", "android", "iphone", "ipad"}
+)
+
+//ClassifyAgent returns class of User-Agent header by well-known markers
+func ClassifyAgent(userAgent string) AgentClass {
+	ua := strings.ToLower(userAgent)
+	switch {
+	case ua == "":
+		return AgentOther
+	case containsAny(ua, botMarkers):
+		return AgentBot
+	case containsAny(ua, cliMarkers):
+		return AgentCLI
+	case containsAny(ua, mobileMarkers):
+		return AgentMobile
+	case strings.HasPrefix(ua, "mozilla/") || strings.HasPrefix(ua, "opera/"):
+		return AgentBrowser
+	default:
+		return AgentOther
+	}
+}
+
+func containsAny(s string, markers []string) bool {
+	for _, marker := range markers {
+		if strings.Contains(s, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+//Granularity is duration of statistics bucket
+type Granularity string
+
+const (
+	Hour Granularity = "hour"
+	Day  Granularity = "day"
+)
+
+//Duration returns length of bucket, zero for unknown granularity
+func (g Granularity) Duration() time.Duration {
+	switch g {
+	case Hour:
+		return time.Hour
+	case Day:
+		return 24 * time.Hour
+	default:
+		return 0
+	}
+}
+
+//MaxBuckets limits number of buckets in one statistics request
+const MaxBuckets = 1000
+
+//Query selects clicks of short link in time range [From, To), counted by buckets of granularity Bucket.
+//FromRollups selects rollups instead of raw clicks, range of such query should be Aligned
+type Query struct {
+	ShortID     string
+	From        time.Time
+	To          time.Time
+	Bucket      Granularity
+	FromRollups bool
+}
+
+//Validate checks query granularity and range
+func (q Query) Validate() error {
+	d := q.Bucket.Duration()
+	switch {
+	case d == 0:
+		return errors.New(`bucket must be "hour" or "day"`)
+	case !q.From.Before(q.To):
+		return errors.New("from must be before to")
+	case q.To.Sub(q.From.UTC().Truncate(d)) > MaxBuckets*d:
+		return errors.New("too many buckets, shorten time range or use larger bucket")
+	}
+	return nil
+}
+
+//Bucket is number of clicks from Start during one granularity period
+type Bucket struct {
+	Start time.Time `json:"start"`
+	Count int64     `json:"count"`
+}
+
+//Stats is statistics of short link. Total counts all clicks, other fields count clicks in query range
+type Stats struct {
+	Total     int64                `json:"total"`
+	Source    string               `json:"source"`
+	From      time.Time            `json:"from"`
+	To        time.Time            `json:"to"`
+	Bucket    Granularity          `json:"bucket"`
+	Buckets   []Bucket             `json:"buckets"`
+	Referrers map[string]int64     `json:"referrers"`
+	Agents    map[AgentClass]int64 `json:"agents"`
+}
+
+//NewStats returns empty statistics for query with zero buckets for whole range. Buckets start at UTC boundaries
+func NewStats(q Query) Stats {
+	d := q.Bucket.Duration()
+	s := Stats{
+		Source:    SourceRaw,
+		From:      q.From.UTC(),
+		To:        q.To.UTC(),
+		Bucket:    q.Bucket,
+		Buckets:   make([]Bucket, 0),
+		Referrers: make(map[string]int64),
+		Agents:    make(map[AgentClass]int64),
+	}
+	if q.FromRollups {
+		s.Source = SourceRollup
+	}
+	for start := s.From.Truncate(d); start.Before(s.To); start = start.Add(d) {
+		s.Buckets = append(s.Buckets, Bucket{Start: start})
+	}
+	return s
+}
+
+//AddBucket adds n clicks to bucket, which contains time t. Time outside of range is ignored
+func (s *Stats) AddBucket(t time.Time, n int64) {
+	if len(s.Buckets) == 0 || t.Before(s.Buckets[0].Start) || !t.Before(s.To) {
+		return
+	}
+	i := int(t.Sub(s.Buckets[0].Start) / s.Bucket.Duration())
+	s.Buckets[i].Count += n
+}
+
+//Add counts one click in statistics
+func (s *Stats) Add(c Click) {
+	s.Total++
+	if c.Time.Before(s.From) || !c.Time.Before(s.To) {
+		return
+	}
+	s.AddBucket(c.Time, 1)
+	s.Referrers[c.Referrer]++
+	s.Agents[c.Agent]++
+}
+
+//Aggregate returns statistics of query by all clicks of short link
+func Aggregate(q Query, clicks []Click) Stats {
+	s := NewStats(q)
+	for _, c := range clicks {
+		s.Add(c)
+	}
+	return s
+}
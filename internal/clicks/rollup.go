@@ -0,0 +1,137 @@
+package clicks
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+)
+
+//Granularities are durations of rollup buckets, kept for every short link
+var Granularities = []Granularity{Hour, Day}
+
+//Sources of statistics
+const (
+	SourceRaw    = "raw"
+	SourceRollup = "rollup"
+)
+
+//RollupRow is number of clicks of short link with one referrer and User-Agent class during one bucket
+type RollupRow struct {
+	ShortID     string      `json:"short_id"`
+	Granularity Granularity `json:"granularity"`
+	Start       time.Time   `json:"start"`
+	Referrer    string      `json:"referrer"`
+	Agent       AgentClass  `json:"agent"`
+	Clicks      int64       `json:"clicks"`
+}
+
+//Rollup aggregates clicks into rows of all granularities. Rows are sorted by key,
+//so concurrent writers update the same rows in the same order
+func Rollup(batch []Click) []RollupRow {
+	type key struct {
+		shortID     string
+		granularity Granularity
+		start       int64
+		referrer    string
+		agent       AgentClass
+	}
+	index := make(map[key]int, len(batch))
+	rows := make([]RollupRow, 0, len(batch))
+	for _, c := range batch {
+		for _, g := range Granularities {
+			start := c.Time.UTC().Truncate(g.Duration())
+			k := key{c.ShortID, g, start.UnixNano(), c.Referrer, c.Agent}
+			i, ok := index[k]
+			if !ok {
+				i = len(rows)
+				index[k] = i
+				rows = append(rows, RollupRow{ShortID: c.ShortID, Granularity: g, Start: start, Referrer: c.Referrer, Agent: c.Agent})
+			}
+			rows[i].Clicks++
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		switch {
+		case a.ShortID != b.ShortID:
+			return a.ShortID < b.ShortID
+		case a.Granularity != b.Granularity:
+			return a.Granularity < b.Granularity
+		case !a.Start.Equal(b.Start):
+			return a.Start.Before(b.Start)
+		case a.Referrer != b.Referrer:
+			return a.Referrer < b.Referrer
+		default:
+			return a.Agent < b.Agent
+		}
+	})
+	return rows
+}
+
+//AddRollup counts rollup row of query granularity, which starts in statistics range. Total is not changed
+func (s *Stats) AddRollup(row RollupRow) {
+	if row.Granularity != s.Bucket || row.Start.Before(s.From) || !row.Start.Before(s.To) {
+		return
+	}
+	s.AddBucket(row.Start, row.Clicks)
+	s.Referrers[row.Referrer] += row.Clicks
+	s.Agents[row.Agent] += row.Clicks
+}
+
+//Aligned returns query with range widened to bucket boundaries, as rollups count whole buckets
+func (q Query) Aligned() Query {
+	d := q.Bucket.Duration()
+	q.From = q.From.UTC().Truncate(d)
+	to := q.To.UTC().Truncate(d)
+	if to.Before(q.To) {
+		to = to.Add(d)
+	}
+	q.To = to
+	return q
+}
+
+//PreferRollups reports whether statistics of query should be read from rollups:
+//range is longer than rollupRange or raw clicks of range may be already purged by retention.
+//Zero rollupRange or retention disables its condition
+func PreferRollups(q Query, now time.Time, rollupRange, retention time.Duration) bool {
+	return (rollupRange > 0 && q.To.Sub(q.From) > rollupRange) ||
+		(retention > 0 && q.From.Before(now.Add(-retention)))
+}
+
+//Purger is storage, which deletes raw clicks before time. Rollups are kept
+type Purger interface {
+	PurgeClicks(ctx context.Context, before time.Time) (int64, error)
+}
+
+//RunRetention starts purging raw clicks older than retention every interval until ctx is canceled.
+//Non-positive retention or interval disables purging. Errors are logged and don't stop retention.
+//Returned channel is closed, when retention has stopped
+func RunRetention(ctx context.Context, store Purger, retention, interval time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+	if retention <= 0 || interval <= 0 {
+		close(done)
+		return done
+	}
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				n, err := store.PurgeClicks(ctx, now.Add(-retention))
+				if err != nil {
+					log.Println("clicks retention: can't purge raw clicks:", err)
+					continue
+				}
+				if n > 0 {
+					log.Printf("clicks retention: %d raw clicks purged\n", n)
+				}
+			}
+		}
+	}()
+	return done
+}
@@ -0,0 +1,151 @@
+package clicks
+
+import (
+	"context"
+	"golang.org/x/sync/errgroup"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+//Defaults of Writer
+const (
+	DefaultBufferSize    = 10000
+	DefaultBatchSize     = 500
+	DefaultFlushInterval = time.Second
+)
+
+//flushTimeout limits flush of remaining clicks after Writer context is canceled
+const flushTimeout = 5 * time.Second
+
+//Writer is buffered asynchronous writer of clicks. Record never blocks:
+//when buffer is full, click is dropped and counted. Clicks are flushed to Store in batches,
+//when batch is full or flush interval has passed. Failed batches are logged and dropped
+type Writer struct {
+	buffer        chan Click
+	bufferSize    int
+	batchSize     int
+	flushInterval time.Duration
+	dropped       *int64
+	g             *errgroup.Group
+	ctx           context.Context
+}
+
+//Option configures Writer in New
+type Option func(w *Writer)
+
+//WithBuffer sets number of clicks, waiting for flush. Non-positive value means default
+func WithBuffer(size int) Option {
+	return func(w *Writer) {
+		if size > 0 {
+			w.bufferSize = size
+		}
+	}
+}
+
+//WithBatching sets max number of clicks in one flush and max time between flushes.
+//Non-positive values mean defaults
+func WithBatching(batchSize int, flushInterval time.Duration) Option {
+	return func(w *Writer) {
+		if batchSize > 0 {
+			w.batchSize = batchSize
+		}
+		if flushInterval > 0 {
+			w.flushInterval = flushInterval
+		}
+	}
+}
+
+//New starts writer of clicks to store. Writer stops, when ctx is canceled, and flushes buffered clicks
+func New(ctx context.Context, store Store, opts ...Option) Writer {
+	g, ctx := errgroup.WithContext(ctx)
+	w := Writer{
+		bufferSize:    DefaultBufferSize,
+		batchSize:     DefaultBatchSize,
+		flushInterval: DefaultFlushInterval,
+		dropped:       new(int64),
+		g:             g,
+		ctx:           ctx,
+	}
+	for _, opt := range opts {
+		opt(&w)
+	}
+	w.buffer = make(chan Click, w.bufferSize)
+	w.g.Go(func() error {
+		w.run(store)
+		return nil
+	})
+	return w
+}
+
+//Record queues click for writing without blocking. Returns false, if buffer is full and click is dropped
+func (w Writer) Record(c Click) bool {
+	select {
+	case w.buffer <- c:
+		return true
+	default:
+		atomic.AddInt64(w.dropped, 1)
+		return false
+	}
+}
+
+//Dropped returns number of clicks, dropped because of full buffer
+func (w Writer) Dropped() int64 {
+	return atomic.LoadInt64(w.dropped)
+}
+
+//run collects clicks into batches and flushes them until context is canceled
+func (w Writer) run(store Store) {
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+	batch := make([]Click, 0, w.batchSize)
+	for {
+		select {
+		case c := <-w.buffer:
+			batch = append(batch, c)
+			if len(batch) >= w.batchSize {
+				batch = w.flush(w.ctx, store, batch)
+			}
+		case <-ticker.C:
+			batch = w.flush(w.ctx, store, batch)
+		case <-w.ctx.Done():
+			w.drain(store, batch)
+			return
+		}
+	}
+}
+
+//drain flushes batch and clicks, remaining in buffer, with own timeout, because writer context is canceled
+func (w Writer) drain(store Store, batch []Click) {
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+	for {
+		select {
+		case c := <-w.buffer:
+			batch = append(batch, c)
+			if len(batch) >= w.batchSize {
+				batch = w.flush(ctx, store, batch)
+			}
+		default:
+			w.flush(ctx, store, batch)
+			return
+		}
+	}
+}
+
+//flush writes batch to store and returns empty batch for reuse
+func (w Writer) flush(ctx context.Context, store Store, batch []Click) []Click {
+	if len(batch) == 0 {
+		return batch
+	}
+	if err := store.AddClicks(ctx, batch); err != nil {
+		log.Printf("clicks writer: %d clicks lost: %v", len(batch), err)
+	}
+	return batch[:0]
+}
+
+//Close waits until writer has flushed remaining clicks. Context of New must be canceled before
+func (w Writer) Close() {
+	_ = w.g.Wait()
+	log.Println("clicks writer has closed")
+}
@@ -0,0 +1,122 @@
+package db
+
+import (
+	"context"
+	"github.com/antonevtu/go_shortener_adv/internal/clicks"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+//upsertRollup adds clicks to rollup row
+const upsertRollup = "insert into click_rollups (short_id, granularity, bucket_start, referrer, agent, clicks) " +
+	"values ($1, $2, $3, $4, $5, $6) on conflict (short_id, granularity, bucket_start, referrer, agent) " +
+	"do update set clicks = click_rollups.clicks + excluded.clicks"
+
+//AddClicks stores batch of clicks in clicks table by COPY protocol and adds them to rollups in one transaction
+func (d *T) AddClicks(ctx context.Context, batch []clicks.Click) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	tx, err := d.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"clicks"}, []string{"short_id", "clicked_at", "referrer", "agent"},
+		pgx.CopyFromSlice(len(batch), func(i int) ([]interface{}, error) {
+			c := batch[i]
+			return []interface{}{c.ShortID, c.Time, c.Referrer, string(c.Agent)}, nil
+		}))
+	if err != nil {
+		return err
+	}
+
+	rollups := &pgx.Batch{}
+	for _, row := range clicks.Rollup(batch) {
+		rollups.Queue(upsertRollup, row.ShortID, string(row.Granularity), row.Start, row.Referrer, string(row.Agent), row.Clicks)
+	}
+	if err = tx.SendBatch(ctx, rollups).Close(); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+//ClickStats returns statistics of one short link, aggregated by database in one round trip.
+//Total is counted by daily rollups, so it includes purged raw clicks
+func (d *T) ClickStats(ctx context.Context, q clicks.Query) (clicks.Stats, error) {
+	stats := clicks.NewStats(q)
+	batch := &pgx.Batch{}
+	batch.Queue("select coalesce(sum(clicks), 0) from click_rollups where short_id = $1 and granularity = $2",
+		q.ShortID, string(clicks.Day))
+	if q.FromRollups {
+		inRange := " from click_rollups where short_id = $1 and bucket_start >= $2 and bucket_start < $3 and granularity = $4"
+		batch.Queue("select bucket_start, sum(clicks)"+inRange+" group by bucket_start", q.ShortID, q.From, q.To, string(q.Bucket))
+		batch.Queue("select referrer, sum(clicks)"+inRange+" group by referrer", q.ShortID, q.From, q.To, string(q.Bucket))
+		batch.Queue("select agent, sum(clicks)"+inRange+" group by agent", q.ShortID, q.From, q.To, string(q.Bucket))
+	} else {
+		inRange := " from clicks where short_id = $1 and clicked_at >= $2 and clicked_at < $3"
+		batch.Queue("select date_trunc($4, clicked_at at time zone 'UTC') at time zone 'UTC', count(*)"+inRange+" group by 1",
+			q.ShortID, q.From, q.To, string(q.Bucket))
+		batch.Queue("select referrer, count(*)"+inRange+" group by referrer", q.ShortID, q.From, q.To)
+		batch.Queue("select agent, count(*)"+inRange+" group by agent", q.ShortID, q.From, q.To)
+	}
+
+	results := d.Pool.SendBatch(ctx, batch)
+	defer results.Close()
+	if err := results.QueryRow().Scan(&stats.Total); err != nil {
+		return stats, err
+	}
+	err := scanCounts(results, func(rows pgx.Rows) error {
+		var start time.Time
+		var n int64
+		err := rows.Scan(&start, &n)
+		stats.AddBucket(start.UTC(), n)
+		return err
+	})
+	if err != nil {
+		return stats, err
+	}
+	err = scanCounts(results, func(rows pgx.Rows) error {
+		var referrer string
+		var n int64
+		err := rows.Scan(&referrer, &n)
+		stats.Referrers[referrer] = n
+		return err
+	})
+	if err != nil {
+		return stats, err
+	}
+	err = scanCounts(results, func(rows pgx.Rows) error {
+		var agent string
+		var n int64
+		err := rows.Scan(&agent, &n)
+		stats.Agents[clicks.AgentClass(agent)] = n
+		return err
+	})
+	return stats, err
+}
+
+//scanCounts reads all rows of the next query in batch by scan
+func scanCounts(results pgx.BatchResults, scan func(rows pgx.Rows) error) error {
+	rows, err := results.Query()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err = scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+//PurgeClicks deletes raw clicks before time. Rollups are kept
+func (d *T) PurgeClicks(ctx context.Context, before time.Time) (int64, error) {
+	tag, err := d.Pool.Exec(ctx, "delete from clicks where clicked_at < $1", before)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
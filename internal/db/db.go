@@ -3,97 +3,189 @@ package db
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/antonevtu/go_shortener_adv/internal/pool"
 	"github.com/jackc/pgconn"
 	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	_ "github.com/lib/pq"
+	"time"
 )
 
 type T struct {
 	*pgxpool.Pool
 }
 
-//Entity is row format for store one short URL
+//Entity is row format for store one short URL. Nil ExpiresAt means link never expires
 type Entity struct {
-	Deleted bool   `json:"deleted"`
-	UserID  string `json:"user_id"`
-	ShortID string `json:"id"`
-	LongURL string `json:"url"`
+	Deleted   bool       `json:"deleted"`
+	UserID    string     `json:"user_id"`
+	ShortID   string     `json:"id"`
+	LongURL   string     `json:"url"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+//Expired reports whether link has expiration time not after now
+func (e Entity) Expired(now time.Time) bool {
+	return e.ExpiresAt != nil && !e.ExpiresAt.After(now)
 }
 
 var ErrUniqueViolation = errors.New("long URL already exist")
 
+//ErrShortIDConflict is returned, if generated short ID is already taken by other long URL.
+//Caller should retry with new short ID
+var ErrShortIDConflict = errors.New("short ID already exist")
+
+//ErrNotFound is returned by selects of one Entity, if it doesn't exist
+var ErrNotFound = errors.New("entity not found")
+
 //New returns object with new DB connection
 //Migrations applied if not exist
 func New(ctx context.Context, url string) (T, error) {
-	var pool T
-	var err error
-	pool.Pool, err = pgxpool.Connect(ctx, url)
+	pool, err := Connect(ctx, url)
 	if err != nil {
 		return pool, err
 	}
 
-	// создание таблицы
-	sql1 := "create table if not exists urls (" +
-		"id serial primary key, " +
-		"deleted boolean not null," +
-		"user_id varchar(512) not null, " +
-		"short_id varchar(512) not null unique, " +
-		"long_url varchar(1024) not null unique)"
-	_, err = pool.Exec(ctx, sql1)
+	err = pool.MigrateUp(ctx)
 	if err != nil {
+		pool.Close()
 		return pool, err
 	}
-
 	return pool, nil
 }
 
-//AddEntity adds new row Entity in DB. If long URL already exists, returns ErrUniqueViolation
+//Connect returns object with new DB connection without applying migrations
+func Connect(ctx context.Context, url string) (T, error) {
+	var pool T
+	var err error
+	pool.Pool, err = pgxpool.Connect(ctx, url)
+	return pool, err
+}
+
+//entityColumns are columns of urls table, scanned into Entity
+const entityColumns = "deleted, user_id, short_id, long_url, expires_at"
+
+//scanEntity scans entityColumns of row into e
+func scanEntity(row pgx.Row, e *Entity) error {
+	return row.Scan(&e.Deleted, &e.UserID, &e.ShortID, &e.LongURL, &e.ExpiresAt)
+}
+
+//insertEntity inserts one row Entity with hash of long URL
+const insertEntity = "insert into urls (deleted, user_id, short_id, long_url, long_url_hash, expires_at) values ($1, $2, $3, $4, $5, $6)"
+
+//LongURLHash returns hex SHA-256 of long URL. Uniqueness of long URLs is enforced on it
+func LongURLHash(longURL string) string {
+	sum := sha256.Sum256([]byte(longURL))
+	return hex.EncodeToString(sum[:])
+}
+
+//reapExpired marks expired rows of long URLs deleted, as reaper does, so they don't hold long URLs.
+//Row of long URL is unique only among not deleted rows
+const reapExpired = "update urls set deleted = true where long_url_hash = any($1) and not deleted and expires_at <= now()"
+
+//onLiveConflict is conflict target of not deleted row of the same long URL
+const onLiveConflict = " on conflict (long_url_hash) where not deleted"
+
+//AddEntity adds new row Entity in DB. If live row of long URL already exists, returns ErrUniqueViolation.
+//Deleted or expired row of the same long URL is kept under its short ID
 func (d *T) AddEntity(ctx context.Context, e Entity) error {
-	sql := "insert into urls values (default, $1, $2, $3, $4)"
-	_, err := d.Pool.Exec(ctx, sql, e.Deleted, e.UserID, e.ShortID, e.LongURL)
+	tx, err := d.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
 
+	hash := LongURLHash(e.LongURL)
+	if _, err = tx.Exec(ctx, reapExpired, []string{hash}); err != nil {
+		return err
+	}
+	tag, err := tx.Exec(ctx, insertEntity+onLiveConflict+" do nothing", e.Deleted, e.UserID, e.ShortID, e.LongURL, hash, e.ExpiresAt)
+	if err != nil {
+		return uniqueViolation(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrUniqueViolation
+	}
+	return tx.Commit(ctx)
+}
+
+//uniqueViolation converts unique constraint errors to ErrShortIDConflict for short ID and ErrUniqueViolation for long URL
+func uniqueViolation(err error) error {
 	var pgErr *pgconn.PgError
-	if errors.As(err, &pgErr) {
-		if pgErr.Code == pgerrcode.UniqueViolation {
-			return ErrUniqueViolation
+	if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+		if pgErr.ConstraintName == "urls_short_id_key" {
+			return ErrShortIDConflict
 		}
+		return ErrUniqueViolation
 	}
 	return err
 }
 
-//SelectByLongURL returns row Entity for known long URL
+//upsertEntity inserts one row Entity or, if live row of long URL already exists, returns existing row.
+//No-op update locks existing row, so it is returned even under concurrent writes
+const upsertEntity = insertEntity + onLiveConflict + " do update set long_url_hash = excluded.long_url_hash returning " + entityColumns
+
+//AddOrGetEntity adds new row Entity in DB or returns existing live row with the same long URL.
+//Deleted or expired row of the same long URL is kept, new row is added under new short ID.
+//created is false if entity already existed. If short ID is taken, returns ErrShortIDConflict
+func (d *T) AddOrGetEntity(ctx context.Context, e Entity) (stored Entity, created bool, err error) {
+	tx, err := d.Begin(ctx)
+	if err != nil {
+		return stored, false, err
+	}
+	defer tx.Rollback(ctx)
+
+	hash := LongURLHash(e.LongURL)
+	if _, err = tx.Exec(ctx, reapExpired, []string{hash}); err != nil {
+		return stored, false, err
+	}
+	err = scanEntity(tx.QueryRow(ctx, upsertEntity, e.Deleted, e.UserID, e.ShortID, e.LongURL, hash, e.ExpiresAt), &stored)
+	if err != nil {
+		return stored, false, uniqueViolation(err)
+	}
+	return stored, stored.ShortID == e.ShortID, tx.Commit(ctx)
+}
+
+//SelectByLongURL returns row Entity for known long URL or ErrNotFound.
+//Of several rows of long URL, not deleted or the latest one is returned
 func (d *T) SelectByLongURL(ctx context.Context, longURL string) (Entity, error) {
-	row := d.Pool.QueryRow(ctx, "select * from urls where long_url = $1", longURL)
+	row := d.Pool.QueryRow(ctx, "select "+entityColumns+" from urls where long_url_hash = $1 order by deleted, id desc limit 1",
+		LongURLHash(longURL))
 	var e Entity
-	var rowID int
-	err := row.Scan(&rowID, &e.Deleted, &e.UserID, &e.ShortID, &e.LongURL)
+	err := scanEntity(row, &e)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return e, ErrNotFound
+	}
 	return e, err
 }
 
-//SelectByShortID returns row Entity for known short ID
+//SelectByShortID returns row Entity for known short ID or ErrNotFound
 func (d *T) SelectByShortID(ctx context.Context, shortID string) (Entity, error) {
-	row := d.Pool.QueryRow(ctx, "select * from urls where short_id = $1", shortID)
+	row := d.Pool.QueryRow(ctx, "select "+entityColumns+" from urls where short_id = $1", shortID)
 	var e Entity
-	var rowID int
-	err := row.Scan(&rowID, &e.Deleted, &e.UserID, &e.ShortID, &e.LongURL)
+	err := scanEntity(row, &e)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return e, ErrNotFound
+	}
 	return e, err
 }
 
 //SelectByUser returns all Entity rows for given userID
 func (d *T) SelectByUser(ctx context.Context, userID string) ([]Entity, error) {
-	rows, err := d.Pool.Query(ctx, "select * from urls where user_id = $1", userID)
+	rows, err := d.Pool.Query(ctx, "select "+entityColumns+" from urls where user_id = $1", userID)
 	if err != nil {
 		return nil, err
 	}
-	var e Entity
-	var rowID int
+	defer rows.Close()
 	eArray := make([]Entity, 0, 10)
 	for rows.Next() {
-		err = rows.Scan(&rowID, &e.Deleted, &e.UserID, &e.ShortID, &e.LongURL)
+		var e Entity // new ExpiresAt pointer for each row
+		err = scanEntity(rows, &e)
 		if err != nil {
 			return nil, err
 		}
@@ -105,64 +197,143 @@ func (d *T) SelectByUser(ctx context.Context, userID string) ([]Entity, error) {
 //BatchInput is slice for batched input several URL
 type BatchInput []BatchInputItem
 type BatchInputItem struct {
-	CorrelationID string `json:"correlation_id"`
-	OriginalURL   string `json:"original_url"`
-	ShortID       string `json:"-"`
-	Deleted       bool   `json:"-"`
+	CorrelationID string      `json:"correlation_id"`
+	OriginalURL   string      `json:"original_url"`
+	Alias         string      `json:"alias,omitempty"`
+	TTL           int64       `json:"ttl,omitempty"`
+	ExpiresAt     *time.Time  `json:"expires_at,omitempty"`
+	ShortID       string      `json:"-"`
+	Deleted       bool        `json:"-"`
+	Status        BatchStatus `json:"-"`
 }
 
-//AddEntityBatch fast adds BatchInput in transaction mode
+//BatchStatus is result of adding one BatchInputItem
+type BatchStatus string
+
+const (
+	BatchCreated    BatchStatus = "created"     // new short URL
+	BatchExists     BatchStatus = "exists"      // long URL was shortened earlier, ShortID is existing one
+	BatchInvalid    BatchStatus = "invalid"     // item rejected before storing
+	BatchAliasTaken BatchStatus = "alias_taken" // requested alias is short ID of other long URL, item is not stored
+)
+
+//upsertAlias is upsertEntity, which inserts nothing and returns no row, if short ID is already taken.
+//Existing live row of the same long URL is returned, if short ID is free
+const upsertAlias = "insert into urls (deleted, user_id, short_id, long_url, long_url_hash, expires_at) " +
+	"select $1::boolean, $2::text, $3::text, $4::text, $5::text, $6::timestamptz where not exists (select 1 from urls where short_id = $3)" +
+	onLiveConflict + " do update set long_url_hash = excluded.long_url_hash returning " + entityColumns
+
+//AddEntityBatch adds BatchInput by insert-or-get statements, pipelined in one round trip and one transaction.
+//Items with status BatchInvalid are skipped. Other items get status BatchCreated or BatchExists,
+//ShortID of already existing long URL is replaced by stored one. Deleted or expired rows are kept, new rows are added.
+//Item with alias, taken by other row, gets status BatchAliasTaken and is not stored.
+//If generated short ID of any new item is taken, nothing is added and ErrShortIDConflict returned
 func (d *T) AddEntityBatch(ctx context.Context, userID string, data BatchInput) error {
+	batch := &pgx.Batch{}
+	hashes := make([]string, 0, len(data))
+	for _, v := range data {
+		if v.Status != BatchInvalid {
+			hashes = append(hashes, LongURLHash(v.OriginalURL))
+		}
+	}
+	batch.Queue(reapExpired, hashes)
+	for _, v := range data {
+		switch {
+		case v.Status == BatchInvalid:
+		case v.Alias != "":
+			batch.Queue(upsertAlias, v.Deleted, userID, v.ShortID, v.OriginalURL, LongURLHash(v.OriginalURL), v.ExpiresAt)
+		default:
+			batch.Queue(upsertEntity, v.Deleted, userID, v.ShortID, v.OriginalURL, LongURLHash(v.OriginalURL), v.ExpiresAt)
+		}
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+
 	tx, err := d.Begin(ctx)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback(ctx)
 
-	stmt, err := tx.Prepare(ctx, "batch", "insert into urls values (default, $1, $2, $3, $4)")
-	if err != nil {
+	results := tx.SendBatch(ctx, batch)
+	if _, err = results.Exec(); err != nil {
+		_ = results.Close()
+		return err
+	}
+	var noRow []int // items with taken alias: long URL may be already stored under the alias
+	for i := range data {
+		if data[i].Status == BatchInvalid {
+			continue
+		}
+		var e Entity
+		err = scanEntity(results.QueryRow(), &e)
+		if data[i].Alias != "" && errors.Is(err, pgx.ErrNoRows) {
+			noRow = append(noRow, i)
+			continue
+		}
+		if err != nil {
+			_ = results.Close()
+			return uniqueViolation(err)
+		}
+		data[i].Status = BatchCreated
+		if e.ShortID != data[i].ShortID {
+			data[i].ShortID, data[i].Status = e.ShortID, BatchExists
+		}
+	}
+	if err = results.Close(); err != nil {
 		return err
 	}
 
-	for _, v := range data {
-		if _, err = tx.Exec(ctx, stmt.Name, v.Deleted, userID, v.ShortID, v.OriginalURL); err != nil {
+	for _, i := range noRow {
+		var shortID string
+		err = tx.QueryRow(ctx, "select short_id from urls where long_url_hash = $1 and not deleted",
+			LongURLHash(data[i].OriginalURL)).Scan(&shortID)
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			data[i].Status = BatchAliasTaken
+		case err != nil:
 			return err
+		default:
+			data[i].ShortID, data[i].Status = shortID, BatchExists
 		}
 	}
 
 	if err := tx.Commit(ctx); err != nil {
 		return fmt.Errorf("unable to commit: %w", err)
 	}
-	return err
+	return nil
 }
 
-//SetDeletedBatch fast delete several Entities in transaction mode
-//Doesn't remove rows, only sets deleted flags = true
-func (d *T) SetDeletedBatch(ctx context.Context, userID string, shortIDs []string) error {
-	tx, err := d.Begin(ctx)
+//SetDeletedBatch deletes several Entities of given user by one set-based statement.
+//Doesn't remove rows, only sets deleted flags = true.
+//Returns short IDs, which belong to user and are deleted now; IDs of other users, unknown and already deleted IDs are ignored
+func (d *T) SetDeletedBatch(ctx context.Context, userID string, shortIDs []string) ([]string, error) {
+	sql := "update urls set deleted = true where user_id = $1 and short_id = any($2) and not deleted returning short_id"
+	rows, err := d.Pool.Query(ctx, sql, userID, shortIDs)
 	if err != nil {
-		return err
-	}
-	defer tx.Rollback(ctx)
-
-	sql := "update urls set deleted = true where short_id = $1 and user_id = $2"
-
-	stmt, err := tx.Prepare(ctx, "batchSetDeleted", sql)
-	if err != nil {
-		return err
+		return nil, err
 	}
-
-	for _, shortID := range shortIDs {
-		_, err = tx.Exec(ctx, stmt.Name, shortID, userID)
-		if err != nil {
-			return err
+	defer rows.Close()
+	deleted := make([]string, 0, len(shortIDs))
+	for rows.Next() {
+		var shortID string
+		if err = rows.Scan(&shortID); err != nil {
+			return nil, err
 		}
+		deleted = append(deleted, shortID)
 	}
+	return deleted, rows.Err()
+}
 
-	if err := tx.Commit(ctx); err != nil {
-		return fmt.Errorf("unable to commit: %w", err)
+//DeleteExpired sets deleted flag for all not deleted Entities with expiration time not after now.
+//Returns number of deleted Entities
+func (d *T) DeleteExpired(ctx context.Context, now time.Time) (int64, error) {
+	tag, err := d.Pool.Exec(ctx, "update urls set deleted = true where not deleted and expires_at <= $1", now)
+	if err != nil {
+		return 0, err
 	}
-	return err
+	return tag.RowsAffected(), nil
 }
 
 //SetDeleted delete one row Entity.
@@ -0,0 +1,61 @@
+package db
+
+import (
+	"context"
+	"github.com/antonevtu/go_shortener_adv/internal/pool"
+	"github.com/jackc/pgx/v4"
+)
+
+//AppendDeletes stores accepted deletions in delete_queue table in one round trip and sets their IDs
+func (d *T) AppendDeletes(ctx context.Context, items []pool.ToDeleteItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	batch := &pgx.Batch{}
+	for _, item := range items {
+		batch.Queue("insert into delete_queue (user_id, short_id, job_id) values ($1, $2, $3) returning id",
+			item.UserID, item.ShortID, item.JobID)
+	}
+
+	tx, err := d.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	results := tx.SendBatch(ctx, batch)
+	for i := range items {
+		if err = results.QueryRow().Scan(&items[i].ID); err != nil {
+			_ = results.Close()
+			return err
+		}
+	}
+	if err = results.Close(); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+//AckDeletes removes processed deletions from delete_queue table
+func (d *T) AckDeletes(ctx context.Context, ids []int64) error {
+	_, err := d.Pool.Exec(ctx, "delete from delete_queue where id = any($1)", ids)
+	return err
+}
+
+//PendingDeletes returns not processed deletions from delete_queue table
+func (d *T) PendingDeletes(ctx context.Context) ([]pool.ToDeleteItem, error) {
+	rows, err := d.Pool.Query(ctx, "select id, user_id, short_id, job_id from delete_queue order by id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := make([]pool.ToDeleteItem, 0, 10)
+	for rows.Next() {
+		var item pool.ToDeleteItem
+		if err = rows.Scan(&item.ID, &item.UserID, &item.ShortID, &item.JobID); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
@@ -0,0 +1,199 @@
+package db
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+//migrationLockKey is key of advisory lock, which serializes migrations of concurrent instances
+const migrationLockKey = 7245193021
+
+//Migration is one schema version with SQL for upgrade and downgrade
+type Migration struct {
+	Version int
+	Name    string
+	up      string
+	down    string
+}
+
+//Migrations returns embedded migrations ordered by version.
+//Files are named NNNN_name.up.sql and NNNN_name.down.sql
+func Migrations() ([]Migration, error) {
+	files, err := fs.ReadDir(migrationsFS, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, file := range files {
+		name := file.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("unexpected migration file %s", name)
+		}
+		base := strings.TrimSuffix(name, "."+direction+".sql")
+		parts := strings.SplitN(base, "_", 2)
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 {
+			return nil, fmt.Errorf("invalid migration file name %s", name)
+		}
+		data, err := migrationsFS.ReadFile(path.Join("migrations", name))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: parts[1]}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.up = string(data)
+		} else {
+			m.down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" {
+			return nil, fmt.Errorf("migration %04d_%s has no up script", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+//LatestVersion returns version of the last embedded migration
+func LatestVersion() (int, error) {
+	migrations, err := Migrations()
+	if err != nil || len(migrations) == 0 {
+		return 0, err
+	}
+	return migrations[len(migrations)-1].Version, nil
+}
+
+//MigrateUp applies all not applied migrations
+func (d *T) MigrateUp(ctx context.Context) error {
+	latest, err := LatestVersion()
+	if err != nil {
+		return err
+	}
+	return d.MigrateTo(ctx, latest)
+}
+
+//MigrateTo applies or rolls back migrations, so that schema gets target version.
+//Each migration runs in its own transaction. Concurrent instances wait on advisory lock
+func (d *T) MigrateTo(ctx context.Context, target int) error {
+	migrations, err := Migrations()
+	if err != nil {
+		return err
+	}
+
+	conn, err := d.Pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	// session-level lock lives on this connection until unlocked
+	if _, err = conn.Exec(ctx, "select pg_advisory_lock($1)", migrationLockKey); err != nil {
+		return err
+	}
+	defer conn.Exec(context.Background(), "select pg_advisory_unlock($1)", migrationLockKey)
+
+	sql1 := "create table if not exists schema_migrations (" +
+		"version integer primary key, " +
+		"name text not null, " +
+		"applied_at timestamptz not null default now())"
+	if _, err = conn.Exec(ctx, sql1); err != nil {
+		return err
+	}
+	applied, err := appliedVersions(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	// upgrade
+	for _, m := range migrations {
+		if m.Version > target || applied[m.Version] {
+			continue
+		}
+		err = runMigration(ctx, conn, m.up, "insert into schema_migrations (version, name) values ($1, $2)", m.Version, m.Name)
+		if err != nil {
+			return fmt.Errorf("migration %04d_%s up: %w", m.Version, m.Name, err)
+		}
+	}
+
+	// downgrade in reverse order
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.Version <= target || !applied[m.Version] {
+			continue
+		}
+		if m.down == "" {
+			return fmt.Errorf("migration %04d_%s has no down script", m.Version, m.Name)
+		}
+		err = runMigration(ctx, conn, m.down, "delete from schema_migrations where version = $1", m.Version)
+		if err != nil {
+			return fmt.Errorf("migration %04d_%s down: %w", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+//SchemaVersion returns the highest applied migration version, 0 for empty database
+func (d *T) SchemaVersion(ctx context.Context) (int, error) {
+	var exists bool
+	err := d.Pool.QueryRow(ctx, "select to_regclass('schema_migrations') is not null").Scan(&exists)
+	if err != nil || !exists {
+		return 0, err
+	}
+	var version int
+	err = d.Pool.QueryRow(ctx, "select coalesce(max(version), 0) from schema_migrations").Scan(&version)
+	return version, err
+}
+
+func appliedVersions(ctx context.Context, conn *pgxpool.Conn) (map[int]bool, error) {
+	rows, err := conn.Query(ctx, "select version from schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if err = rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+//runMigration executes migration script and bookkeeping statement in one transaction
+func runMigration(ctx context.Context, conn *pgxpool.Conn, script string, bookkeeping string, args ...interface{}) error {
+	return conn.BeginFunc(ctx, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, script); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, bookkeeping, args...)
+		return err
+	})
+}
@@ -0,0 +1,8 @@
+-- existing deployments already have this table, created before migrations were introduced
+create table if not exists urls (
+    id serial primary key,
+    deleted boolean not null,
+    user_id varchar(512) not null,
+    short_id varchar(512) not null unique,
+    long_url varchar(1024) not null unique
+);
@@ -0,0 +1,5 @@
+-- fails if URLs longer than 1024 characters were stored
+alter table urls drop constraint urls_long_url_hash_key;
+alter table urls drop column long_url_hash;
+alter table urls alter column long_url type varchar(1024);
+alter table urls add constraint urls_long_url_key unique (long_url);
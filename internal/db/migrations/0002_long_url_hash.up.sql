@@ -0,0 +1,7 @@
+-- long URLs are unbounded, uniqueness is enforced on SHA-256 hash instead of wide value
+alter table urls drop constraint if exists urls_long_url_key;
+alter table urls alter column long_url type text;
+alter table urls add column long_url_hash char(64);
+update urls set long_url_hash = encode(sha256(convert_to(long_url, 'UTF8')), 'hex');
+alter table urls alter column long_url_hash set not null;
+alter table urls add constraint urls_long_url_hash_key unique (long_url_hash);
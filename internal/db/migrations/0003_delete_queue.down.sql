@@ -0,0 +1 @@
+drop table delete_queue;
@@ -0,0 +1,7 @@
+-- journal of accepted, but not yet processed deletions
+create table delete_queue (
+    id bigserial primary key,
+    user_id text not null,
+    short_id text not null,
+    created_at timestamptz not null default now()
+);
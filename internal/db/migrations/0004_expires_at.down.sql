@@ -0,0 +1,2 @@
+drop index if exists urls_expires_at;
+alter table urls drop column expires_at;
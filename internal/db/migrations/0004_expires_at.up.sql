@@ -0,0 +1,3 @@
+-- links without expiration time never expire
+alter table urls add column expires_at timestamptz;
+create index urls_expires_at on urls (expires_at) where expires_at is not null and not deleted;
@@ -0,0 +1,9 @@
+-- raw redirects of short links for statistics
+create table clicks (
+    id bigserial primary key,
+    short_id text not null,
+    clicked_at timestamptz not null,
+    referrer text not null,
+    agent text not null
+);
+create index clicks_short_id_clicked_at on clicks (short_id, clicked_at);
@@ -0,0 +1,2 @@
+drop index if exists clicks_clicked_at;
+drop table if exists click_rollups;
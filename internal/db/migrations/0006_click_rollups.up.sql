@@ -0,0 +1,17 @@
+-- hourly and daily counts of clicks, kept after raw clicks are purged by retention
+create table click_rollups (
+    short_id text not null,
+    granularity text not null,
+    bucket_start timestamptz not null,
+    referrer text not null,
+    agent text not null,
+    clicks bigint not null,
+    primary key (short_id, granularity, bucket_start, referrer, agent)
+);
+insert into click_rollups (short_id, granularity, bucket_start, referrer, agent, clicks)
+select short_id, 'hour', date_trunc('hour', clicked_at at time zone 'UTC') at time zone 'UTC', referrer, agent, count(*)
+from clicks group by 1, 2, 3, 4, 5;
+insert into click_rollups (short_id, granularity, bucket_start, referrer, agent, clicks)
+select short_id, 'day', date_trunc('day', clicked_at at time zone 'UTC') at time zone 'UTC', referrer, agent, count(*)
+from clicks group by 1, 2, 3, 4, 5;
+create index clicks_clicked_at on clicks (clicked_at);
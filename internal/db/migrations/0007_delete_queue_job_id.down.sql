@@ -0,0 +1 @@
+alter table delete_queue drop column job_id;
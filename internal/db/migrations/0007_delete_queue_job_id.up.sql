@@ -0,0 +1,2 @@
+-- job of deletion, so job status survives restart; empty for deletions without job
+alter table delete_queue add column job_id text not null default '';
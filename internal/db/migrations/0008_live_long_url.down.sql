@@ -0,0 +1,3 @@
+-- fails if deleted link was shortened again
+drop index urls_long_url_hash_live;
+alter table urls add constraint urls_long_url_hash_key unique (long_url_hash);
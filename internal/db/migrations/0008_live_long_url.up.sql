@@ -0,0 +1,3 @@
+-- deleted links keep their rows and short IDs, so long URL is unique only among not deleted links
+alter table urls drop constraint urls_long_url_hash_key;
+create unique index urls_long_url_hash_live on urls (long_url_hash) where not deleted;
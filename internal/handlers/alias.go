@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/antonevtu/go_shortener_adv/internal/db"
+	"strings"
+)
+
+//Limits of alias length
+const (
+	minAliasLength = 3
+	maxAliasLength = 64
+)
+
+//reservedAliases are first path segments of service routes. Aliases can't shadow them
+var reservedAliases = map[string]bool{
+	"api":     true,
+	"debug":   true,
+	"ping":    true,
+	"admin":   true,
+	"health":  true,
+	"metrics": true,
+	"static":  true,
+}
+
+var (
+	ErrAliasInvalid  = errors.New("alias may contain only latin letters, digits, '-' and '_'")
+	ErrAliasReserved = errors.New("alias is reserved")
+)
+
+//validateAlias checks alias, requested instead of generated short ID
+func validateAlias(alias string) error {
+	if len(alias) < minAliasLength || len(alias) > maxAliasLength {
+		return fmt.Errorf("alias length must be from %d to %d symbols", minAliasLength, maxAliasLength)
+	}
+	for _, r := range alias {
+		if !(r >= '0' && r <= '9' || r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r == '-' || r == '_') {
+			return ErrAliasInvalid
+		}
+	}
+	if reservedAliases[strings.ToLower(alias)] {
+		return fmt.Errorf("%w: %q", ErrAliasReserved, alias)
+	}
+	return nil
+}
+
+//shortenWithAlias stores entity under alias. If long URL already exists, returns existing entity.
+//If alias is taken by other long URL, returns db.ErrShortIDConflict; uniqueness is checked by repository atomically
+func shortenWithAlias(ctx context.Context, repo Repositorier, entity db.Entity, alias string) (e db.Entity, created bool, err error) {
+	entity.ShortID = alias
+	err = repo.AddEntity(ctx, entity)
+	if errors.Is(err, db.ErrUniqueViolation) {
+		e, err = repo.SelectByLongURL(ctx, entity.LongURL)
+		return e, false, err
+	}
+	return entity, err == nil, err
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+//expiration returns expiration time of link from TTL in seconds or absolute time expiresAt.
+//Zero TTL and nil expiresAt mean link without expiration, result is nil.
+//Time is truncated to seconds in UTC, so all backends store it equally
+func expiration(ttl int64, expiresAt *time.Time, now time.Time) (*time.Time, error) {
+	if ttl != 0 && expiresAt != nil {
+		return nil, errors.New("only one of ttl and expires_at may be set")
+	}
+	if ttl < 0 {
+		return nil, fmt.Errorf("ttl must be positive, got %d", ttl)
+	}
+	var t time.Time
+	switch {
+	case ttl > 0:
+		t = now.Add(time.Duration(ttl) * time.Second)
+	case expiresAt != nil:
+		t = *expiresAt
+	default:
+		return nil, nil
+	}
+	t = t.UTC().Truncate(time.Second)
+	if !t.After(now) {
+		return nil, errors.New("expires_at must be in the future")
+	}
+	return &t, nil
+}
+
+//expirationFromQuery returns expiration time of link from query parameters ttl (seconds) or expires_at (RFC 3339)
+func expirationFromQuery(query url.Values, now time.Time) (*time.Time, error) {
+	var ttl int64
+	var expiresAt *time.Time
+	if v := query.Get("ttl"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse ttl: %w", err)
+		}
+		ttl = n
+	}
+	if v := query.Get("expires_at"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse expires_at: %w", err)
+		}
+		expiresAt = &t
+	}
+	return expiration(ttl, expiresAt, now)
+}
@@ -5,13 +5,19 @@ import (
 	"context"
 	"github.com/antonevtu/go_shortener_adv/internal/db"
 	"github.com/antonevtu/go_shortener_adv/internal/pool"
+	"time"
 )
 
 type Repositorier interface {
 
-	//AddEntity adds new row Entity in DB. If long URL already exists, returns ErrUniqueViolation
+	//AddEntity adds new row Entity in DB. If long URL already exists, returns ErrUniqueViolation,
+	//if short ID is taken, returns ErrShortIDConflict
 	AddEntity(ctx context.Context, entity db.Entity) error
 
+	//AddOrGetEntity adds new row Entity in DB or returns existing row with the same long URL atomically.
+	//created is false if entity already existed
+	AddOrGetEntity(ctx context.Context, entity db.Entity) (stored db.Entity, created bool, err error)
+
 	//SelectByLongURL returns row Entity for known long URL
 	SelectByLongURL(ctx context.Context, longURL string) (db.Entity, error)
 
@@ -21,15 +27,22 @@ type Repositorier interface {
 	//SelectByUser returns all Entity rows for given userID
 	SelectByUser(ctx context.Context, userID string) ([]db.Entity, error)
 
-	//AddEntityBatch fast adds BatchInput in transaction mode
+	//AddEntityBatch fast adds BatchInput, skipping items with status db.BatchInvalid.
+	//Sets status db.BatchCreated or db.BatchExists for other items, ShortID of existing long URL is replaced by stored one.
+	//Item with alias, taken by other long URL, gets status db.BatchAliasTaken.
+	//Taken generated short ID fails the whole batch with db.ErrShortIDConflict
 	AddEntityBatch(ctx context.Context, userID string, input db.BatchInput) error
 
 	//Ping checks DB connection is alive
 	Ping(ctx context.Context) error
 
-	//SetDeletedBatch fast delete several Entities in transaction mode
-	//Doesn't remove rows, only sets deleted flags = true
-	SetDeletedBatch(ctx context.Context, userID string, shortIDs []string) error
+	//SetDeletedBatch fast delete several Entities of given user by one statement
+	//Doesn't remove rows, only sets deleted flags = true. Returns short IDs, which belong to user and are deleted now, not the already deleted ones
+	SetDeletedBatch(ctx context.Context, userID string, shortIDs []string) ([]string, error)
+
+	//DeleteExpired sets deleted flag for all not deleted Entities with expiration time not after now.
+	//Returns number of deleted Entities
+	DeleteExpired(ctx context.Context, now time.Time) (int64, error)
 
 	//SetDeleted delete one row Entity.
 	//Doesn't remove row, only sets deleted flag = true
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/antonevtu/go_shortener_adv/internal/cfg"
+	"net/http"
+)
+
+//Compactor is implemented by repositories with compactable storage log
+type Compactor interface {
+	//Compact rewrites storage log as snapshot of live entities
+	Compact() error
+}
+
+// handlerCompact compacts repository storage log on demand
+func handlerCompact(repo Repositorier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		compactor, ok := repo.(Compactor)
+		if !ok {
+			http.Error(w, "compaction not supported", http.StatusNotImplemented)
+			return
+		}
+		err := compactor.Compact()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// handlerDeadLetters returns items, which deleter pool failed to delete after all retries
+func handlerDeadLetters(cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfgApp.DeleterPool == nil {
+			http.Error(w, "deleter pool not configured", http.StatusNotImplemented)
+			return
+		}
+		jsonResponse, err := json.Marshal(cfgApp.DeleterPool.DeadLetters())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(jsonResponse)
+	}
+}
+
+type replayResponse struct {
+	Replayed int `json:"replayed"`
+}
+
+// handlerReplayDeadLetters queues dead items to deleter pool again
+func handlerReplayDeadLetters(cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfgApp.DeleterPool == nil {
+			http.Error(w, "deleter pool not configured", http.StatusNotImplemented)
+			return
+		}
+		n, err := cfgApp.DeleterPool.Replay(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		jsonResponse, err := json.Marshal(replayResponse{Replayed: n})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(jsonResponse)
+	}
+}
+
+// handlerDeleterQueue returns depth of deleter pool queue in total and by users
+func handlerDeleterQueue(cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfgApp.DeleterPool == nil {
+			http.Error(w, "deleter pool not configured", http.StatusNotImplemented)
+			return
+		}
+		jsonResponse, err := json.Marshal(cfgApp.DeleterPool.QueueStats())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(jsonResponse)
+	}
+}
@@ -1,25 +1,37 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/antonevtu/go_shortener_adv/internal/cfg"
 	"github.com/antonevtu/go_shortener_adv/internal/pool"
+	"github.com/go-chi/chi/v5"
 	"io"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 type shortIDList []string
 
-// handlerDelete receives shortIDList from body and sends it to deleter pool for deferred execution
+// handlerDelete receives shortIDList from body and submits it to deleter pool as job for deferred execution.
+// Returns job ID in body and job status URL in Location header.
+// Request with more than cfgApp.DeleteMaxIDs IDs or more IDs than deleter queue size is rejected with 413.
+// If queue has no room during cfgApp.DeleteTimeout, returns 503 with Retry-After. Without deleter pool returns 503
 func handlerDelete(cfgApp cfg.Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if cfgApp.DeleterPool == nil {
+			http.Error(w, "deleter pool not configured", http.StatusServiceUnavailable)
+			return
+		}
 		userIDBytes, err := getUserID(r)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		userID := userIDBytes.String()
-		_ = userID
 
 		body, err := io.ReadAll(r.Body)
 		if err != nil {
@@ -34,10 +46,94 @@ func handlerDelete(cfgApp cfg.Config) http.HandlerFunc {
 			return
 		}
 
-		for _, shortID := range shortIDs {
-			cfgApp.DeleterChan <- pool.ToDeleteItem{UserID: userID, ShortID: shortID}
+		if cfgApp.DeleteMaxIDs > 0 && len(shortIDs) > cfgApp.DeleteMaxIDs {
+			http.Error(w, fmt.Sprintf("too many IDs in request: %d, max %d", len(shortIDs), cfgApp.DeleteMaxIDs),
+				http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		// 202 is sent only after deletions are journaled by pool.
+		// If queue stays full during enqueue timeout, client should retry later
+		ctx := r.Context()
+		if cfgApp.DeleteTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, cfgApp.DeleteTimeout)
+			defer cancel()
+		}
+		jobID, err := cfgApp.DeleterPool.Submit(ctx, userID, shortIDs)
+		if errors.Is(err, pool.ErrQueueFull) {
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter(cfgApp.DeleteTimeout)))
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if errors.Is(err, pool.ErrTooManyItems) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 
+		jsonResponse, err := json.Marshal(responseJobID{JobID: jobID})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", cfgApp.BaseURL+"/api/user/jobs/"+jobID)
 		w.WriteHeader(http.StatusAccepted)
+		_, err = w.Write(jsonResponse)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+type responseJobID struct {
+	JobID string `json:"job_id"`
+}
+
+// handlerJob returns status of delete job with per short ID outcomes.
+// Job of other user is not found. Without deleter pool returns 503
+func handlerJob(cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfgApp.DeleterPool == nil {
+			http.Error(w, "deleter pool not configured", http.StatusServiceUnavailable)
+			return
+		}
+		userID, err := getUserID(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		job, ok := cfgApp.DeleterPool.Job(chi.URLParam(r, "id"))
+		if !ok || job.UserID != userID.String() {
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		}
+
+		jsonResponse, err := json.Marshal(job)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, err = w.Write(jsonResponse)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// retryAfter returns delay in seconds for Retry-After header: enqueue timeout rounded up, at least 1 second
+func retryAfter(timeout time.Duration) int {
+	seconds := int((timeout + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		return 1
 	}
+	return seconds
 }
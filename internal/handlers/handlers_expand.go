@@ -4,13 +4,15 @@ import (
 	"context"
 	"encoding/json"
 	"github.com/antonevtu/go_shortener_adv/internal/cfg"
+	"github.com/antonevtu/go_shortener_adv/internal/clicks"
 	"github.com/go-chi/chi/v5"
 	"net/http"
 	"time"
 )
 
 // handlerExpandURL receives shor id from URL request in format: /{id}
-// returns redirect to original long URL for any user
+// returns redirect to original long URL for any user, 410 for deleted or expired link.
+// Redirect is recorded to click writer without waiting for storage
 func handlerExpandURL(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id := chi.URLParam(r, "id")
@@ -21,10 +23,13 @@ func handlerExpandURL(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		if entity.Deleted {
+		if entity.Deleted || entity.Expired(time.Now()) {
 			w.WriteHeader(http.StatusGone)
 			return
 		} else {
+			if cfgApp.ClickWriter != nil {
+				cfgApp.ClickWriter.Record(clicks.NewClick(entity.ShortID, r.Referer(), r.UserAgent(), time.Now()))
+			}
 			w.Header().Set("Location", entity.LongURL)
 			w.WriteHeader(http.StatusTemporaryRedirect)
 			return
@@ -34,8 +39,9 @@ func handlerExpandURL(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
 
 type responseUserHistory []item
 type item struct {
-	ShortURL    string `json:"short_url"`
-	OriginalURL string `json:"original_url"`
+	ShortURL    string     `json:"short_url"`
+	OriginalURL string     `json:"original_url"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
 }
 
 // handlerUserHistory returns array responseUserHistory by user ID, extracted from cookie
@@ -64,6 +70,7 @@ func handlerUserHistory(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
 				history[i] = item{
 					ShortURL:    cfgApp.BaseURL + "/" + v.ShortID,
 					OriginalURL: v.LongURL,
+					ExpiresAt:   v.ExpiresAt,
 				}
 			}
 			js, err := json.Marshal(history)
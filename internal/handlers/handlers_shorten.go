@@ -4,16 +4,20 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/antonevtu/go_shortener_adv/internal/cfg"
 	"github.com/antonevtu/go_shortener_adv/internal/db"
-	"github.com/google/uuid"
 	"io"
 	"net/http"
+	"net/url"
 	"time"
 )
 
 type requestURL struct {
-	URL string `json:"url"`
+	URL       string     `json:"url"`
+	Alias     string     `json:"alias,omitempty"`
+	TTL       int64      `json:"ttl,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
 }
 
 type responseURL struct {
@@ -23,9 +27,11 @@ type responseURL struct {
 //handlerShortenURLJSONAPI receives request for shorten URL from body in format requestURL.
 //Returns in body BaseURL + "/" + shortID in format responseURL.
 //If requested long URL already exists in repository, returns existing short URL.
+//Optional alias is used instead of generated short ID; taken alias gives 409 with error message.
+//Optional ttl in seconds or expires_at sets expiration time of new link.
 //UserID extracts from cookie.
 //Assigns userID for unknown user.
-func handlerShortenURLJSONAPI(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
+func handlerShortenURLJSONAPI(repo Repositorier, cfgApp cfg.Config, gen ShortIDGenerator) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userID, err := getUserID(r)
 		if err != nil {
@@ -50,23 +56,43 @@ func handlerShortenURLJSONAPI(repo Repositorier, cfgApp cfg.Config) http.Handler
 			return
 		}
 
-		shortID := uuid.NewString() // ID короткого URL
+		if longURL.Alias != "" {
+			if err = validateAlias(longURL.Alias); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		expiresAt, err := expiration(longURL.TTL, longURL.ExpiresAt, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		entity := db.Entity{UserID: userID.String(), LongURL: longURL.URL, ExpiresAt: expiresAt}
 
-		// запрос в БД на сохранение URL. Замена id на существующий в случае дублирования longURL
+		// запрос в БД на сохранение URL под новым ID или псевдонимом. Замена id на существующий в случае дублирования longURL
 		var statusCode = http.StatusCreated
 		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(cfgApp.CtxTimeout)*time.Second)
 		defer cancel()
-		err = repo.AddEntity(ctx, db.Entity{UserID: userID.String(), ShortID: shortID, LongURL: longURL.URL})
-		if errors.Is(err, db.ErrUniqueViolation) {
-			var e db.Entity
-			e, err = repo.SelectByLongURL(ctx, longURL.URL)
-			shortID = e.ShortID
-			statusCode = http.StatusConflict
+		var e db.Entity
+		var created bool
+		if longURL.Alias != "" {
+			e, created, err = shortenWithAlias(ctx, repo, entity, longURL.Alias)
+		} else {
+			e, created, err = shortenWithRetry(ctx, repo, gen, entity)
+		}
+		// без псевдонима конфликт значит, что попытки генерации ID исчерпаны, это ошибка сервера
+		if longURL.Alias != "" && errors.Is(err, db.ErrShortIDConflict) {
+			http.Error(w, fmt.Sprintf("alias %q is already taken", longURL.Alias), http.StatusConflict)
+			return
 		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		shortID := e.ShortID
+		if !created {
+			statusCode = http.StatusConflict
+		}
 
 		// Ответ на запрос
 		response := responseURL{Result: cfgApp.BaseURL + "/" + shortID}
@@ -87,12 +113,13 @@ func handlerShortenURLJSONAPI(repo Repositorier, cfgApp cfg.Config) http.Handler
 	}
 }
 
-//handlerShortenURLJSONAPI receives request for shorten URL from body in text format.
+//handlerShortenURL receives request for shorten URL from body in text format.
+//Optional query parameters ttl (seconds) or expires_at (RFC 3339) set expiration time of new link.
 //Returns in body BaseURL + "/" + shortID in text format.
 //If requested long URL already exists in repository, returns existing short URL.
 //UserID extracts from cookie.
 //Assigns userID for unknown user.
-func handlerShortenURL(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
+func handlerShortenURL(repo Repositorier, cfgApp cfg.Config, gen ShortIDGenerator) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userID, err := getUserID(r)
 		if err != nil {
@@ -106,24 +133,25 @@ func handlerShortenURL(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
 			return
 		}
 		longURL := string(body)
+		expiresAt, err := expirationFromQuery(r.URL.Query(), time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-		shortID := uuid.NewString()
-
-		// запрос в БД на сохранение URL. Замена id на существующий в случае дублирования longURL
+		// запрос в БД на сохранение URL под новым ID. Замена id на существующий в случае дублирования longURL
 		var statusCode = http.StatusCreated
 		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(cfgApp.CtxTimeout)*time.Second)
 		defer cancel()
-		err = repo.AddEntity(ctx, db.Entity{UserID: userID.String(), ShortID: shortID, LongURL: longURL})
-		if errors.Is(err, db.ErrUniqueViolation) {
-			var e db.Entity
-			e, err = repo.SelectByLongURL(ctx, longURL)
-			shortID = e.ShortID
-			statusCode = http.StatusConflict
-		}
+		e, created, err := shortenWithRetry(ctx, repo, gen, db.Entity{UserID: userID.String(), LongURL: longURL, ExpiresAt: expiresAt})
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		shortID := e.ShortID
+		if !created {
+			statusCode = http.StatusConflict
+		}
 
 		shortURL := cfgApp.BaseURL + "/" + shortID
 
@@ -140,17 +168,20 @@ func handlerShortenURL(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
 
 type batchOutput []batchOutputItem
 type batchOutputItem struct {
-	CorrelationID string `json:"correlation_id"`
-	ShortURL      string `json:"short_url"`
+	CorrelationID string         `json:"correlation_id"`
+	ShortURL      string         `json:"short_url,omitempty"`
+	Status        db.BatchStatus `json:"status"`
 }
 
 //handlerShortenURLAPIBatch receives array of long URL from body in format db.BatchInput
-//for fast shorten in transaction mode.
-//Returns response in body in batchOutput format.
-//If any long URL exists in DB, returns error.
+//for fast shorten in one round trip to DB.
+//Item may have optional alias, used instead of generated short ID, and ttl or expires_at of link.
+//Returns response in body in batchOutput format with status of each item:
+//created, exists (with existing short URL), invalid (not absolute URL, bad alias or expiration, no short URL)
+//or alias_taken (alias belongs to other long URL, no short URL).
 //UserID extracts from cookie.
 //Assigns userID for unknown user.
-func handlerShortenURLAPIBatch(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
+func handlerShortenURLAPIBatch(repo Repositorier, cfgApp cfg.Config, gen ShortIDGenerator) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userID, err := getUserID(r)
 		if err != nil {
@@ -171,14 +202,24 @@ func handlerShortenURLAPIBatch(repo Repositorier, cfgApp cfg.Config) http.Handle
 			return
 		}
 
-		// generate ID's for short URL's
+		// invalid items are not stored, ID's for short URL's are generated for others
+		now := time.Now()
 		for i := range input {
-			input[i].ShortID = uuid.NewString()
+			input[i].Status = ""
+			if !isValidURL(input[i].OriginalURL) {
+				input[i].Status = db.BatchInvalid
+			}
+			if input[i].Alias != "" && validateAlias(input[i].Alias) != nil {
+				input[i].Status = db.BatchInvalid
+			}
+			if input[i].ExpiresAt, err = expiration(input[i].TTL, input[i].ExpiresAt, now); err != nil {
+				input[i].Status = db.BatchInvalid
+			}
 		}
 
 		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(cfgApp.CtxTimeout)*time.Second)
 		defer cancel()
-		err = repo.AddEntityBatch(ctx, userID.String(), input)
+		err = batchWithRetry(ctx, repo, gen, userID.String(), input)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -186,8 +227,11 @@ func handlerShortenURLAPIBatch(repo Repositorier, cfgApp cfg.Config) http.Handle
 
 		output := make(batchOutput, len(input))
 		for i := range input {
-			output[i].ShortURL = cfgApp.BaseURL + "/" + input[i].ShortID
 			output[i].CorrelationID = input[i].CorrelationID
+			output[i].Status = input[i].Status
+			if input[i].Status != db.BatchInvalid && input[i].Status != db.BatchAliasTaken {
+				output[i].ShortURL = cfgApp.BaseURL + "/" + input[i].ShortID
+			}
 		}
 
 		jsonResponse, err := json.Marshal(output)
@@ -207,6 +251,12 @@ func handlerShortenURLAPIBatch(repo Repositorier, cfgApp cfg.Config) http.Handle
 	}
 }
 
+//isValidURL reports whether s is absolute URL with host
+func isValidURL(s string) bool {
+	u, err := url.ParseRequestURI(s)
+	return err == nil && u.Scheme != "" && u.Host != ""
+}
+
 // handlerPingDB checks DB is alive
 func handlerPingDB(repo Repositorier) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
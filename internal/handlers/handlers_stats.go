@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/antonevtu/go_shortener_adv/internal/cfg"
+	"github.com/antonevtu/go_shortener_adv/internal/clicks"
+	"github.com/antonevtu/go_shortener_adv/internal/db"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+//defaultStatsBuckets is number of buckets in statistics range, if from is not requested
+const defaultStatsBuckets = 30
+
+type responseStats struct {
+	ShortURL string `json:"short_url"`
+	clicks.Stats
+}
+
+// handlerStats returns click statistics of short link, owned by user from cookie.
+// Query parameters: bucket (hour or day, default day), from and to (RFC 3339, default last 30 buckets till now).
+// Long ranges are read from hourly or daily rollups and widened to whole buckets.
+// Link of other user is not found
+func handlerStats(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := getUserID(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		store, ok := repo.(clicks.Store)
+		if !ok {
+			http.Error(w, "click statistics not supported", http.StatusNotImplemented)
+			return
+		}
+
+		now := time.Now()
+		q, err := statsQuery(chi.URLParam(r, "id"), r.URL.Query(), now)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// long ranges and ranges with purged raw clicks are read from rollups by whole buckets
+		if clicks.PreferRollups(q, now, cfgApp.ClickRollupFrom, cfgApp.ClickRetention) {
+			q = q.Aligned()
+			q.FromRollups = true
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(cfgApp.CtxTimeout)*time.Second)
+		defer cancel()
+		entity, err := repo.SelectByShortID(ctx, q.ShortID)
+		if errors.Is(err, db.ErrNotFound) || (err == nil && entity.UserID != userID.String()) {
+			http.Error(w, "short URL not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		stats, err := store.ClickStats(ctx, q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		jsonResponse, err := json.Marshal(responseStats{ShortURL: cfgApp.BaseURL + "/" + q.ShortID, Stats: stats})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		setCookie(w, userID)
+		w.Header().Set("Content-Type", "application/json")
+		_, err = w.Write(jsonResponse)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+//statsQuery parses statistics query parameters
+func statsQuery(shortID string, query url.Values, now time.Time) (clicks.Query, error) {
+	q := clicks.Query{ShortID: shortID, To: now, Bucket: clicks.Day}
+	if v := query.Get("bucket"); v != "" {
+		q.Bucket = clicks.Granularity(v)
+	}
+	if v := query.Get("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return q, fmt.Errorf("can't parse to: %w", err)
+		}
+		q.To = t
+	}
+	q.From = q.To.Add(-defaultStatsBuckets * q.Bucket.Duration())
+	if v := query.Get("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return q, fmt.Errorf("can't parse from: %w", err)
+		}
+		q.From = t
+	}
+	return q, q.Validate()
+}
@@ -8,6 +8,9 @@ import (
 )
 
 func NewRouter(repo Repositorier, cfgApp cfg.Config) chi.Router {
+	// генератор коротких ID, настройки проверены cfg.New
+	gen := mustShortIDGenerator(cfgApp)
+
 	// Определяем роутер chi
 	r := chi.NewRouter()
 
@@ -23,13 +26,23 @@ func NewRouter(repo Repositorier, cfgApp cfg.Config) chi.Router {
 
 	// создадим суброутер
 	r.Route("/", func(r chi.Router) {
-		r.Post("/", handlerShortenURL(repo, cfgApp))
-		r.Post("/api/shorten", handlerShortenURLJSONAPI(repo, cfgApp))
+		r.Post("/", handlerShortenURL(repo, cfgApp, gen))
+		r.Post("/api/shorten", handlerShortenURLJSONAPI(repo, cfgApp, gen))
 		r.Get("/{id}", handlerExpandURL(repo, cfgApp))
 		r.Get("/api/user/urls", handlerUserHistory(repo, cfgApp))
+		r.Get("/api/user/urls/{id}/stats", handlerStats(repo, cfgApp))
 		r.Get("/ping", handlerPingDB(repo))
-		r.Post("/api/shorten/batch", handlerShortenURLAPIBatch(repo, cfgApp))
+		r.Post("/api/shorten/batch", handlerShortenURLAPIBatch(repo, cfgApp, gen))
 		r.Delete("/api/user/urls", handlerDelete(cfgApp))
+		r.Get("/api/user/jobs/{id}", handlerJob(cfgApp))
+
+		// обслуживание хранилища
+		r.Post("/debug/storage/compact", handlerCompact(repo))
+
+		// необработанные удаления
+		r.Get("/debug/deleter/dead", handlerDeadLetters(cfgApp))
+		r.Post("/debug/deleter/dead/replay", handlerReplayDeadLetters(cfgApp))
+		r.Get("/debug/deleter/queue", handlerDeleterQueue(cfgApp))
 
 		// профилировщик
 		r.HandleFunc("/debug/pprof/", pprof.Index)
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/antonevtu/go_shortener_adv/internal/cfg"
+	"github.com/antonevtu/go_shortener_adv/internal/db"
+	"github.com/google/uuid"
+	"math/big"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+//maxShortIDAttempts limits regeneration of short ID, taken by other long URL
+const maxShortIDAttempts = 5
+
+//ShortIDGenerator makes short IDs for new long URLs.
+//attempt is number of previous collisions for the same long URL, deterministic generators use it as salt
+type ShortIDGenerator interface {
+	NewShortID(longURL string, attempt int) (string, error)
+}
+
+//NewShortIDGenerator returns generator of strategy cfgApp.ShortIDStrategy.
+//Empty strategy, alphabet and length mean cfg defaults
+func NewShortIDGenerator(cfgApp cfg.Config) (ShortIDGenerator, error) {
+	alphabet := cfgApp.ShortIDAlphabet
+	if alphabet == "" {
+		alphabet = cfg.DefaultShortIDAlphabet
+	}
+	length := cfgApp.ShortIDLength
+	if length <= 0 {
+		length = cfg.DefaultShortIDLength
+	}
+	if err := cfg.ValidateShortID(cfgApp.ShortIDStrategy, alphabet, length); err != nil {
+		return nil, err
+	}
+
+	switch cfgApp.ShortIDStrategy {
+	case cfg.ShortIDUUID:
+		return uuidGenerator{}, nil
+	case cfg.ShortIDCounter:
+		// counter starts from current time, so IDs of restarted service don't repeat earlier ones
+		return &counterGenerator{alphabet: alphabet, length: length, counter: uint64(time.Now().UnixNano() / int64(time.Millisecond))}, nil
+	case cfg.ShortIDHash:
+		return hashGenerator{alphabet: alphabet, length: length}, nil
+	default:
+		return randomGenerator{alphabet: alphabet, length: length}, nil
+	}
+}
+
+//uuidGenerator makes 36-character UUID, as before generators were introduced
+type uuidGenerator struct{}
+
+func (uuidGenerator) NewShortID(_ string, _ int) (string, error) {
+	return uuid.NewString(), nil
+}
+
+//randomGenerator makes cryptographically random IDs of fixed length
+type randomGenerator struct {
+	alphabet string
+	length   int
+}
+
+func (g randomGenerator) NewShortID(_ string, _ int) (string, error) {
+	base := big.NewInt(int64(len(g.alphabet)))
+	id := make([]byte, g.length)
+	for i := range id {
+		n, err := rand.Int(rand.Reader, base)
+		if err != nil {
+			return "", err
+		}
+		id[i] = g.alphabet[n.Int64()]
+	}
+	return string(id), nil
+}
+
+//counterGenerator encodes increasing counter, padded to length. Counter, which outgrows length, is an error
+type counterGenerator struct {
+	alphabet string
+	length   int
+	counter  uint64
+}
+
+func (g *counterGenerator) NewShortID(_ string, _ int) (string, error) {
+	n := atomic.AddUint64(&g.counter, 1)
+	if !cfg.CounterFits(n, len(g.alphabet), g.length) {
+		return "", fmt.Errorf("short ID counter %d doesn't fit in %d symbols", n, g.length)
+	}
+	return encode(n, g.alphabet, g.length), nil
+}
+
+//hashGenerator makes ID from SHA-256 of long URL, so the same URL always gets the same ID.
+//Collision with other URL is resolved by salting hash with attempt
+type hashGenerator struct {
+	alphabet string
+	length   int
+}
+
+func (g hashGenerator) NewShortID(longURL string, attempt int) (string, error) {
+	data := longURL
+	if attempt > 0 {
+		data += "#" + strconv.Itoa(attempt)
+	}
+	sum := sha256.Sum256([]byte(data))
+	n := new(big.Int).SetBytes(sum[:])
+	base := big.NewInt(int64(len(g.alphabet)))
+	id := make([]byte, g.length)
+	mod := new(big.Int)
+	for i := range id {
+		n.DivMod(n, base, mod)
+		id[i] = g.alphabet[mod.Int64()]
+	}
+	return string(id), nil
+}
+
+//encode returns n in positional system of alphabet, left-padded by the first symbol to length
+func encode(n uint64, alphabet string, length int) string {
+	base := uint64(len(alphabet))
+	buf := make([]byte, 0, 16)
+	for ; n > 0; n /= base {
+		buf = append(buf, alphabet[n%base])
+	}
+	for len(buf) < length {
+		buf = append(buf, alphabet[0])
+	}
+	for i, j := 0, len(buf)-1; i < j; i, j = i+1, j-1 {
+		buf[i], buf[j] = buf[j], buf[i]
+	}
+	return string(buf)
+}
+
+//mustShortIDGenerator is NewShortIDGenerator for config, already validated by cfg.New
+func mustShortIDGenerator(cfgApp cfg.Config) ShortIDGenerator {
+	gen, err := NewShortIDGenerator(cfgApp)
+	if err != nil {
+		panic(fmt.Sprintf("short ID generator: %v", err))
+	}
+	return gen
+}
+
+//shortenWithRetry stores entity under generated short ID or returns existing entity of the same long URL.
+//Short ID, taken by other long URL, is regenerated up to maxShortIDAttempts times
+func shortenWithRetry(ctx context.Context, repo Repositorier, gen ShortIDGenerator, entity db.Entity) (e db.Entity, created bool, err error) {
+	for attempt := 0; attempt < maxShortIDAttempts; attempt++ {
+		entity.ShortID, err = gen.NewShortID(entity.LongURL, attempt)
+		if err != nil {
+			return e, false, err
+		}
+		e, created, err = repo.AddOrGetEntity(ctx, entity)
+		if !errors.Is(err, db.ErrShortIDConflict) {
+			return e, created, err
+		}
+	}
+	return e, false, fmt.Errorf("no free short ID after %d attempts: %w", maxShortIDAttempts, db.ErrShortIDConflict)
+}
+
+//batchWithRetry stores valid items of batch with generated short IDs or their aliases.
+//On collision of any generated short ID the whole batch is regenerated, up to maxShortIDAttempts times
+func batchWithRetry(ctx context.Context, repo Repositorier, gen ShortIDGenerator, userID string, input db.BatchInput) error {
+	for attempt := 0; attempt < maxShortIDAttempts; attempt++ {
+		for i := range input {
+			if input[i].Status == db.BatchInvalid {
+				continue
+			}
+			input[i].Status = ""
+			if input[i].Alias != "" {
+				input[i].ShortID = input[i].Alias
+				continue
+			}
+			shortID, err := gen.NewShortID(input[i].OriginalURL, attempt)
+			if err != nil {
+				return err
+			}
+			input[i].ShortID = shortID
+		}
+		err := repo.AddEntityBatch(ctx, userID, input)
+		if !errors.Is(err, db.ErrShortIDConflict) {
+			return err
+		}
+	}
+	return fmt.Errorf("no free short IDs after %d attempts: %w", maxShortIDAttempts, db.ErrShortIDConflict)
+}
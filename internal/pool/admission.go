@@ -0,0 +1,66 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+//Defaults of queue
+const (
+	DefaultWorkers   = 4
+	DefaultQueueSize = 1000
+)
+
+//ErrQueueFull is returned by Enqueue, if queue has no room for items until context is done
+var ErrQueueFull = errors.New("deleter queue is full")
+
+//ErrTooManyItems is returned by Enqueue, if items can't fit in queue even when it is empty
+var ErrTooManyItems = errors.New("too many items for deleter queue")
+
+//WithWorkers sets number of workers. Non-positive value means default
+func WithWorkers(n int) Option {
+	return func(p *DeleterPoolT) {
+		if n > 0 {
+			p.numWorkers = n
+		}
+	}
+}
+
+//WithQueueSize sets max number of queued, but not yet taken by workers items. Non-positive value means default
+func WithQueueSize(n int) Option {
+	return func(p *DeleterPoolT) {
+		if n > 0 {
+			p.queueSize = n
+		}
+	}
+}
+
+//Enqueue accepts items for deferred deleting. Room for all items is reserved in queue first,
+//so request is either admitted as a whole or rejected with ErrQueueFull, when ctx is done.
+//Request larger than queue size is rejected with ErrTooManyItems at once.
+//With journal items are persisted before queueing,
+//so when Enqueue returns nil, items will be deleted even after restart
+func (p DeleterPoolT) Enqueue(ctx context.Context, items []ToDeleteItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	if len(items) > p.queueSize {
+		return fmt.Errorf("%w: %d items exceed queue size %d", ErrTooManyItems, len(items), p.queueSize)
+	}
+	if p.ctx.Err() != nil {
+		return errors.New("deleter pool is stopped")
+	}
+	n := int64(len(items))
+	if err := p.slots.Acquire(ctx, n); err != nil {
+		return ErrQueueFull
+	}
+	if p.journal != nil {
+		if err := p.journal.AppendDeletes(ctx, items); err != nil {
+			p.slots.Release(n)
+			return err
+		}
+	}
+	p.queue.push(items...)
+	return nil
+}
@@ -0,0 +1,131 @@
+package pool
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+//Defaults of retries and dead-letter store
+const (
+	DefaultRetryAttempts = 5
+	DefaultRetryDelay    = 100 * time.Millisecond
+	DefaultRetryMaxDelay = 5 * time.Second
+	DefaultDeadLetters   = 10000
+)
+
+//WithRetry sets number of attempts for one batch and bounds of exponential backoff between attempts.
+//Non-positive values mean defaults
+func WithRetry(attempts int, baseDelay, maxDelay time.Duration) Option {
+	return func(p *DeleterPoolT) {
+		if attempts > 0 {
+			p.retry.attempts = attempts
+		}
+		if baseDelay > 0 {
+			p.retry.baseDelay = baseDelay
+		}
+		if maxDelay > 0 {
+			p.retry.maxDelay = maxDelay
+		}
+	}
+}
+
+//WithDeadLetters sets max number of items in dead-letter store. Non-positive value means default
+func WithDeadLetters(capacity int) Option {
+	return func(p *DeleterPoolT) {
+		if capacity > 0 {
+			p.dead.capacity = capacity
+		}
+	}
+}
+
+type retryT struct {
+	attempts  int
+	baseDelay time.Duration
+	maxDelay  time.Duration
+}
+
+//delay returns backoff after failed attempt (1-based): baseDelay doubled for each attempt,
+//limited by maxDelay, with random jitter in upper half, so workers don't retry in lockstep
+func (r retryT) delay(attempt int) time.Duration {
+	d := r.maxDelay
+	if attempt < 32 {
+		if exp := r.baseDelay << (attempt - 1); exp > 0 && exp < r.maxDelay {
+			d = exp
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+//DeadItem is item, which was not deleted after all attempts.
+//It stays pending in journal, so it is resumed after restart, if not replayed earlier
+type DeadItem struct {
+	ToDeleteItem
+	Err      string    `json:"error"`
+	Attempts int       `json:"attempts"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+//deadLettersT is bounded store of dead items. When it is full, the oldest items are dropped
+type deadLettersT struct {
+	lock     sync.Mutex
+	items    []DeadItem
+	capacity int
+}
+
+func (d *deadLettersT) add(items []ToDeleteItem, err error, attempts int) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	log.Printf("deleter pool: %d items of user %s moved to dead letters after %d attempts: %v", len(items), items[0].UserID, attempts, err)
+	now := time.Now()
+	for _, item := range items {
+		d.items = append(d.items, DeadItem{
+			ToDeleteItem: item,
+			Err:          err.Error(),
+			Attempts:     attempts,
+			FailedAt:     now,
+		})
+	}
+	if dropped := len(d.items) - d.capacity; dropped > 0 {
+		log.Printf("deleter pool: dead letters are full, %d oldest items dropped", dropped)
+		d.items = append(d.items[:0:0], d.items[dropped:]...)
+	}
+}
+
+//deadLetter moves items to dead-letter store and marks them failed in their jobs
+func (p DeleterPoolT) deadLetter(items []ToDeleteItem, err error, attempts int) {
+	p.dead.add(items, err, attempts)
+	for _, item := range items {
+		p.jobs.set(item.JobID, item.ShortID, OutcomeFailed)
+	}
+}
+
+//DeadLetters returns copy of items in dead-letter store
+func (p DeleterPoolT) DeadLetters() []DeadItem {
+	p.dead.lock.Lock()
+	defer p.dead.lock.Unlock()
+	return append(make([]DeadItem, 0, len(p.dead.items)), p.dead.items...)
+}
+
+//Replay moves items from dead-letter store back to pool input and returns number of moved items.
+//If ctx is done before all items are queued, the rest stays in store
+func (p DeleterPoolT) Replay(ctx context.Context) (int, error) {
+	p.dead.lock.Lock()
+	items := p.dead.items
+	p.dead.items = nil
+	p.dead.lock.Unlock()
+
+	for i, item := range items {
+		if err := p.slots.Acquire(ctx, 1); err != nil {
+			p.dead.lock.Lock()
+			p.dead.items = append(items[i:], p.dead.items...)
+			p.dead.lock.Unlock()
+			return i, err
+		}
+		p.jobs.set(item.JobID, item.ShortID, OutcomePending)
+		p.queue.push(item.ToDeleteItem)
+	}
+	return len(items), nil
+}
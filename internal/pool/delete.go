@@ -1,66 +1,182 @@
 //Package pool implements deferred deleting rows from DB
 //with goroutines pool.
+//Queued items are kept in per-user sub-queues. Workers serve users round-robin,
+//taking one batch of a user, when it reaches batch size or its oldest item waits max latency,
+//so bulk deleting of one user doesn't starve small requests of others.
+//Failed batches are retried with exponential backoff and then moved to bounded dead-letter store,
+//so errors of repository never stop the pool.
+//With journal accepted items are persisted before queueing and resumed after restart.
+//Without journal items, queued at shutdown, are deleted before workers stop.
+//Queue has bounded capacity: Enqueue admits request only if there is room for all its items.
 package pool
 
 import (
 	"context"
-	"fmt"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 	"log"
+	"time"
 )
 
+//Defaults of batching
+const (
+	DefaultBatchSize  = 100
+	DefaultMaxLatency = 100 * time.Millisecond
+)
+
+//drainTimeout limits deleting of items, remaining in queue after pool context is canceled
+const drainTimeout = 5 * time.Second
+
 type DeleterPoolT struct {
-	Input chan ToDeleteItem
-	g     *errgroup.Group
-	ctx   context.Context
-	ErrCh chan error
+	queue      *queueT
+	slots      *semaphore.Weighted // free places in queue
+	queueSize  int
+	numWorkers int
+	g          *errgroup.Group
+	ctx        context.Context
+	batchSize  int
+	maxLatency time.Duration
+	retry      retryT
+	dead       *deadLettersT
+	journal    Journal
+	jobs       *jobsT
+	lookup     OwnerLookup
 }
 
+//ToDeleteItem is one short ID to delete. ID is assigned by journal, zero without journal.
+//JobID is ID of job, created by Submit
 type ToDeleteItem struct {
-	UserID  string
-	ShortID string
+	ID      int64  `json:"id,omitempty"`
+	JobID   string `json:"job_id,omitempty"`
+	UserID  string `json:"user_id"`
+	ShortID string `json:"short_id"`
 }
 
 type Deleter interface {
-	SetDeleted(ctx context.Context, item ToDeleteItem) error
+	SetDeletedBatch(ctx context.Context, userID string, shortIDs []string) ([]string, error)
+}
+
+//Option configures DeleterPoolT in New
+type Option func(p *DeleterPoolT)
+
+//WithBatching sets max number of items in one flush and max time, item waits in worker before flush.
+//Non-positive values mean defaults
+func WithBatching(batchSize int, maxLatency time.Duration) Option {
+	return func(p *DeleterPoolT) {
+		if batchSize > 0 {
+			p.batchSize = batchSize
+		}
+		if maxLatency > 0 {
+			p.maxLatency = maxLatency
+		}
+	}
 }
 
-func New(ctx context.Context, repo Deleter) DeleterPoolT {
-	input := make(chan ToDeleteItem, 1000)
+func New(ctx context.Context, repo Deleter, opts ...Option) DeleterPoolT {
 	g, ctx := errgroup.WithContext(ctx)
-	errCh := make(chan error)
 	pool := DeleterPoolT{
-		Input: input,
-		g:     g,
-		ctx:   ctx,
-		ErrCh: errCh,
+		queueSize:  DefaultQueueSize,
+		numWorkers: DefaultWorkers,
+		g:          g,
+		ctx:        ctx,
+		batchSize:  DefaultBatchSize,
+		maxLatency: DefaultMaxLatency,
+		retry:      retryT{attempts: DefaultRetryAttempts, baseDelay: DefaultRetryDelay, maxDelay: DefaultRetryMaxDelay},
+		dead:       &deadLettersT{capacity: DefaultDeadLetters},
+		jobs:       &jobsT{byID: make(map[string]*jobT), capacity: DefaultJobs},
+	}
+	for _, opt := range opts {
+		opt(&pool)
 	}
-	go pool.Run(repo)
+	pool.queue = newQueue()
+	pool.slots = semaphore.NewWeighted(int64(pool.queueSize))
+	pool.start(repo)
 	return pool
 }
 
-func (p DeleterPoolT) Run(repo Deleter) {
-	numWorkers := 4
-
-	for i := 0; i < numWorkers; i++ {
+//start runs workers and resuming of journal. They are started before New returns,
+//so Close always waits for them
+func (p DeleterPoolT) start(repo Deleter) {
+	for i := 0; i < p.numWorkers; i++ {
 		p.g.Go(func() error {
-			for {
-				select {
-				case item := <-p.Input:
-					err := repo.SetDeleted(p.ctx, item)
-					if err != nil {
-						return err
-					}
-				case <-p.ctx.Done():
-					//log.Println("deleter worker has stopped")
-					return nil
-				}
-			}
+			return p.worker(repo)
 		})
 	}
+	if p.journal != nil {
+		p.g.Go(p.resume)
+	}
+}
+
+//worker takes ready batches from queue and deletes them, until pool context is canceled.
+//Then remaining items are drained, so accepted deletions are not lost without journal
+func (p DeleterPoolT) worker(repo Deleter) error {
+	for p.ctx.Err() == nil {
+		items, wait := p.queue.pop(p.batchSize, p.maxLatency, time.Now())
+		if len(items) > 0 {
+			p.slots.Release(int64(len(items)))
+			p.deleteWithRetry(p.ctx, repo, items[0].UserID, items)
+			continue
+		}
+
+		var deadline <-chan time.Time // nil while queue is empty
+		if wait >= 0 {
+			deadline = time.After(wait)
+		}
+		select {
+		case <-p.queue.wake:
+		case <-deadline:
+		case <-p.ctx.Done():
+		}
+	}
+	p.drain(repo)
+	//log.Println("deleter worker has stopped")
+	return nil
+}
 
-	if err := p.g.Wait(); err != nil {
-		p.ErrCh <- fmt.Errorf("error in deleter pool: %w", err)
+//drain deletes all queued items without waiting for batches to fill, with own timeout,
+//because pool context is canceled
+func (p DeleterPoolT) drain(repo Deleter) {
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	for {
+		items, _ := p.queue.pop(p.batchSize, 0, time.Now())
+		if len(items) == 0 {
+			return
+		}
+		p.slots.Release(int64(len(items)))
+		p.deleteWithRetry(ctx, repo, items[0].UserID, items)
+	}
+}
+
+//deleteWithRetry calls SetDeletedBatch until success or attempts are exhausted.
+//Items of successful call get outcomes in their jobs and are acknowledged in journal,
+//items of failed call are moved to dead-letter store
+func (p DeleterPoolT) deleteWithRetry(ctx context.Context, repo Deleter, userID string, items []ToDeleteItem) {
+	shortIDs := make([]string, len(items))
+	for i, item := range items {
+		shortIDs[i] = item.ShortID
+	}
+	attempt := 1
+	for {
+		deleted, err := repo.SetDeletedBatch(ctx, userID, shortIDs)
+		if err == nil {
+			p.resolve(ctx, userID, items, deleted)
+			p.ack(ctx, items)
+			return
+		}
+		if attempt >= p.retry.attempts {
+			p.deadLetter(items, err, attempt)
+			return
+		}
+		delay := p.retry.delay(attempt)
+		log.Printf("deleter pool: attempt %d of %d failed, retry in %v: %v", attempt, p.retry.attempts, delay, err)
+		select {
+		case <-time.After(delay):
+			attempt++
+		case <-ctx.Done():
+			p.deadLetter(items, err, attempt)
+			return
+		}
 	}
 }
 
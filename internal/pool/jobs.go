@@ -0,0 +1,248 @@
+package pool
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"sync"
+	"time"
+)
+
+//DefaultJobs is number of the latest jobs, kept for status requests
+const DefaultJobs = 10000
+
+//Outcome is result of deleting one short ID of job
+type Outcome string
+
+const (
+	OutcomePending   Outcome = "pending"
+	OutcomeDeleted   Outcome = "deleted"
+	OutcomeNotFound  Outcome = "not_found"
+	OutcomeForbidden Outcome = "forbidden" // short ID belongs to other user
+	OutcomeFailed    Outcome = "failed"    // moved to dead letters or owner lookup failed
+)
+
+//Job statuses
+const (
+	JobPending = "pending"
+	JobDone    = "done"
+)
+
+//OwnerLookup returns owner of short ID. found is false for unknown short ID.
+//It distinguishes not found and forbidden outcomes of short IDs, which were not deleted
+type OwnerLookup func(ctx context.Context, shortID string) (userID string, found bool, err error)
+
+//WithOwnerLookup sets lookup of owners. Without it not deleted short IDs are reported as not found
+func WithOwnerLookup(lookup OwnerLookup) Option {
+	return func(p *DeleterPoolT) {
+		p.lookup = lookup
+	}
+}
+
+//WithJobRetention sets number of the latest jobs, kept for status requests. Non-positive value means default
+func WithJobRetention(n int) Option {
+	return func(p *DeleterPoolT) {
+		if n > 0 {
+			p.jobs.capacity = n
+		}
+	}
+}
+
+//JobItem is outcome of one short ID of job
+type JobItem struct {
+	ShortID string  `json:"short_id"`
+	Outcome Outcome `json:"status"`
+}
+
+//Job is status of one delete request.
+//With journal pending job survives restart, but CreatedAt is reset and items, deleted before restart, are dropped
+type Job struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"-"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	Items     []JobItem `json:"items"`
+}
+
+type jobT struct {
+	Job
+	index   map[string]int // short ID -> index in Items
+	pending int
+}
+
+//jobsT is bounded in-memory store of jobs. When it is full, the oldest jobs are evicted
+type jobsT struct {
+	lock     sync.Mutex
+	byID     map[string]*jobT
+	order    []string
+	capacity int
+}
+
+func (j *jobsT) create(userID string, shortIDs []string) *jobT {
+	job := newJob(uuid.NewString(), userID, shortIDs)
+	j.add(job)
+	return job
+}
+
+//restore recreates pending jobs of items, resumed from journal.
+//Items, processed before restart, are no longer journaled, so restored job has only resumed items
+func (j *jobsT) restore(items []ToDeleteItem) {
+	var order []string
+	byJob := make(map[string][]ToDeleteItem)
+	for _, item := range items {
+		if item.JobID == "" {
+			continue
+		}
+		if _, ok := byJob[item.JobID]; !ok {
+			order = append(order, item.JobID)
+		}
+		byJob[item.JobID] = append(byJob[item.JobID], item)
+	}
+	for _, id := range order {
+		jobItems := byJob[id]
+		shortIDs := make([]string, len(jobItems))
+		for i, item := range jobItems {
+			shortIDs[i] = item.ShortID
+		}
+		j.add(newJob(id, jobItems[0].UserID, shortIDs))
+	}
+}
+
+//newJob returns pending job with one item per unique short ID
+func newJob(id, userID string, shortIDs []string) *jobT {
+	job := &jobT{
+		Job: Job{
+			ID:        id,
+			UserID:    userID,
+			Status:    JobPending,
+			CreatedAt: time.Now(),
+			Items:     make([]JobItem, 0, len(shortIDs)),
+		},
+		index: make(map[string]int, len(shortIDs)),
+	}
+	for _, shortID := range shortIDs {
+		if _, ok := job.index[shortID]; ok {
+			continue
+		}
+		job.index[shortID] = len(job.Items)
+		job.Items = append(job.Items, JobItem{ShortID: shortID, Outcome: OutcomePending})
+	}
+	job.pending = len(job.Items)
+	return job
+}
+
+//add stores job and evicts the oldest jobs above capacity
+func (j *jobsT) add(job *jobT) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.byID[job.ID] = job
+	j.order = append(j.order, job.ID)
+	if evicted := len(j.order) - j.capacity; evicted > 0 {
+		for _, id := range j.order[:evicted] {
+			delete(j.byID, id)
+		}
+		j.order = append(j.order[:0:0], j.order[evicted:]...)
+	}
+}
+
+func (j *jobsT) remove(id string) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	delete(j.byID, id)
+	for i, v := range j.order {
+		if v == id {
+			j.order = append(j.order[:i], j.order[i+1:]...)
+			break
+		}
+	}
+}
+
+//set records outcome of short ID of job. Job is done, when all its short IDs have final outcomes
+func (j *jobsT) set(jobID, shortID string, outcome Outcome) {
+	if jobID == "" {
+		return
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	job, ok := j.byID[jobID]
+	if !ok {
+		return
+	}
+	i, ok := job.index[shortID]
+	if !ok {
+		return
+	}
+	switch {
+	case job.Items[i].Outcome == OutcomePending && outcome != OutcomePending:
+		job.pending--
+	case job.Items[i].Outcome != OutcomePending && outcome == OutcomePending:
+		job.pending++
+	}
+	job.Items[i].Outcome = outcome
+	job.Status = JobPending
+	if job.pending == 0 {
+		job.Status = JobDone
+	}
+}
+
+//Submit creates job for deleting short IDs of user and enqueues its items.
+//Repeated short IDs are deleted once. Returns ID of job for Job requests
+func (p DeleterPoolT) Submit(ctx context.Context, userID string, shortIDs []string) (string, error) {
+	job := p.jobs.create(userID, shortIDs)
+	items := make([]ToDeleteItem, len(job.Items))
+	for i, v := range job.Items {
+		items[i] = ToDeleteItem{JobID: job.ID, UserID: userID, ShortID: v.ShortID}
+	}
+	if err := p.Enqueue(ctx, items); err != nil {
+		p.jobs.remove(job.ID)
+		return "", err
+	}
+	return job.ID, nil
+}
+
+//Job returns copy of job status. ok is false for unknown or evicted job
+func (p DeleterPoolT) Job(id string) (job Job, ok bool) {
+	p.jobs.lock.Lock()
+	defer p.jobs.lock.Unlock()
+	j, ok := p.jobs.byID[id]
+	if !ok {
+		return Job{}, false
+	}
+	job = j.Job
+	job.Items = append([]JobItem(nil), j.Items...)
+	return job, true
+}
+
+//resolve records outcomes of items after SetDeletedBatch call for their user
+func (p DeleterPoolT) resolve(ctx context.Context, userID string, items []ToDeleteItem, deleted []string) {
+	isDeleted := make(map[string]bool, len(deleted))
+	for _, shortID := range deleted {
+		isDeleted[shortID] = true
+	}
+	for _, item := range items {
+		if item.JobID == "" {
+			continue
+		}
+		p.jobs.set(item.JobID, item.ShortID, p.outcome(ctx, userID, item.ShortID, isDeleted[item.ShortID]))
+	}
+}
+
+//outcome classifies short ID, which was not returned as deleted, by its owner
+func (p DeleterPoolT) outcome(ctx context.Context, userID, shortID string, deleted bool) Outcome {
+	if deleted {
+		return OutcomeDeleted
+	}
+	if p.lookup == nil {
+		return OutcomeNotFound
+	}
+	owner, found, err := p.lookup(ctx, shortID)
+	switch {
+	case err != nil:
+		return OutcomeFailed
+	case !found:
+		return OutcomeNotFound
+	case owner != userID:
+		return OutcomeForbidden
+	default:
+		return OutcomeDeleted
+	}
+}
@@ -0,0 +1,64 @@
+package pool
+
+import (
+	"context"
+	"log"
+)
+
+//Journal persists accepted items, so they survive restart until processed
+type Journal interface {
+	//AppendDeletes durably stores items with their job IDs and sets their IDs in place
+	AppendDeletes(ctx context.Context, items []ToDeleteItem) error
+
+	//AckDeletes removes processed items by IDs
+	AckDeletes(ctx context.Context, ids []int64) error
+
+	//PendingDeletes returns stored items, which are not acknowledged yet, in order of appending
+	PendingDeletes(ctx context.Context) ([]ToDeleteItem, error)
+}
+
+//WithJournal persists accepted items in journal before queueing
+func WithJournal(journal Journal) Option {
+	return func(p *DeleterPoolT) {
+		p.journal = journal
+	}
+}
+
+//resume queues items, which were left pending in journal by previous run, and restores their jobs
+func (p DeleterPoolT) resume() error {
+	items, err := p.journal.PendingDeletes(p.ctx)
+	if err != nil {
+		log.Printf("deleter pool: can't read journal: %v", err)
+		return nil
+	}
+	p.jobs.restore(items)
+	if len(items) > 0 {
+		log.Printf("deleter pool: %d pending items resumed from journal", len(items))
+	}
+	for _, item := range items {
+		if err = p.slots.Acquire(p.ctx, 1); err != nil {
+			return nil
+		}
+		p.queue.push(item)
+	}
+	return nil
+}
+
+//ack removes processed items from journal. Failed ack only repeats idempotent deleting after restart
+func (p DeleterPoolT) ack(ctx context.Context, items []ToDeleteItem) {
+	if p.journal == nil {
+		return
+	}
+	ids := make([]int64, 0, len(items))
+	for _, item := range items {
+		if item.ID != 0 {
+			ids = append(ids, item.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	if err := p.journal.AckDeletes(ctx, ids); err != nil {
+		log.Printf("deleter pool: can't acknowledge %d items in journal: %v", len(ids), err)
+	}
+}
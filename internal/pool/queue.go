@@ -0,0 +1,136 @@
+package pool
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+//queueT is set of per-user FIFO sub-queues, served round-robin
+type queueT struct {
+	lock   sync.Mutex
+	byUser map[string]*userQueueT
+	ring   []string      // users with queued items in order of service
+	next   int           // position in ring of user to serve next
+	size   int           // items in all sub-queues
+	wake   chan struct{} // signals idle workers about new items
+}
+
+type userQueueT struct {
+	items []ToDeleteItem
+	since time.Time // time of the oldest item
+}
+
+func newQueue() *queueT {
+	return &queueT{
+		byUser: make(map[string]*userQueueT),
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+//push appends items to sub-queues of their users
+func (q *queueT) push(items ...ToDeleteItem) {
+	q.lock.Lock()
+	now := time.Now()
+	for _, item := range items {
+		uq, ok := q.byUser[item.UserID]
+		if !ok {
+			uq = &userQueueT{since: now}
+			q.byUser[item.UserID] = uq
+			q.ring = append(q.ring, item.UserID)
+		}
+		uq.items = append(uq.items, item)
+	}
+	q.size += len(items)
+	q.lock.Unlock()
+	q.signal()
+}
+
+func (q *queueT) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+//pop takes up to batchSize items of the next user in round-robin order, whose sub-queue is ready:
+//it has batchSize items or its oldest item waits maxLatency.
+//If no sub-queue is ready, returns time until the earliest one gets ready, or -1 for empty queue
+func (q *queueT) pop(batchSize int, maxLatency time.Duration, now time.Time) ([]ToDeleteItem, time.Duration) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	wait := time.Duration(-1)
+	for i := 0; i < len(q.ring); i++ {
+		pos := (q.next + i) % len(q.ring)
+		userID := q.ring[pos]
+		uq := q.byUser[userID]
+		ready := now.Sub(uq.since)
+		if len(uq.items) < batchSize && ready < maxLatency {
+			if w := maxLatency - ready; wait < 0 || w < wait {
+				wait = w
+			}
+			continue
+		}
+
+		n := len(uq.items)
+		if n > batchSize {
+			n = batchSize
+		}
+		items := append([]ToDeleteItem(nil), uq.items[:n]...)
+		uq.items = uq.items[n:]
+		q.size -= n
+		if len(uq.items) == 0 {
+			delete(q.byUser, userID)
+			q.ring = append(q.ring[:pos], q.ring[pos+1:]...)
+			q.next = pos
+		} else {
+			q.next = pos + 1
+		}
+		if len(q.ring) > 0 {
+			q.next %= len(q.ring)
+		} else {
+			q.next = 0
+		}
+		if q.size > 0 {
+			// other workers may serve the rest
+			q.signal()
+		}
+		return items, 0
+	}
+	return nil, wait
+}
+
+//UserDepth is number of queued items of one user
+type UserDepth struct {
+	UserID string `json:"user_id"`
+	Depth  int    `json:"depth"`
+}
+
+//QueueStats is snapshot of queue depth
+type QueueStats struct {
+	Total    int         `json:"total"`
+	Capacity int         `json:"capacity"`
+	Users    []UserDepth `json:"users"`
+}
+
+//QueueStats returns queue depth in total and by users, the deepest sub-queues first
+func (p DeleterPoolT) QueueStats() QueueStats {
+	p.queue.lock.Lock()
+	defer p.queue.lock.Unlock()
+	stats := QueueStats{
+		Total:    p.queue.size,
+		Capacity: p.queueSize,
+		Users:    make([]UserDepth, 0, len(p.queue.byUser)),
+	}
+	for userID, uq := range p.queue.byUser {
+		stats.Users = append(stats.Users, UserDepth{UserID: userID, Depth: len(uq.items)})
+	}
+	sort.Slice(stats.Users, func(i, j int) bool {
+		if stats.Users[i].Depth != stats.Users[j].Depth {
+			return stats.Users[i].Depth > stats.Users[j].Depth
+		}
+		return stats.Users[i].UserID < stats.Users[j].UserID
+	})
+	return stats
+}
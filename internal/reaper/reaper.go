@@ -0,0 +1,47 @@
+//Package reaper periodically soft-deletes expired links,
+//so they disappear from storage queries and deletion is persisted by backend.
+//Expired links are answered with 410 Gone even before reaper has processed them
+package reaper
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+//Expirer is storage, which soft-deletes links with expiration time not after now
+type Expirer interface {
+	DeleteExpired(ctx context.Context, now time.Time) (int64, error)
+}
+
+//Run starts deleting expired links every interval until ctx is canceled. Non-positive interval disables reaper.
+//Errors are logged and don't stop reaper. Returned channel is closed, when reaper has stopped,
+//so storage may be closed only after it
+func Run(ctx context.Context, repo Expirer, interval time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+	if interval <= 0 {
+		close(done)
+		return done
+	}
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				n, err := repo.DeleteExpired(ctx, now)
+				if err != nil {
+					log.Println("reaper: can't delete expired links:", err)
+					continue
+				}
+				if n > 0 {
+					log.Printf("reaper: %d expired links deleted\n", n)
+				}
+			}
+		}
+	}()
+	return done
+}
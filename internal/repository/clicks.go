@@ -0,0 +1,135 @@
+package repository
+
+import (
+	"context"
+	"github.com/antonevtu/go_shortener_adv/internal/clicks"
+	"time"
+)
+
+//rollupKey is rollup row of one short ID without number of clicks
+type rollupKey struct {
+	granularity clicks.Granularity
+	start       int64 // unix nanoseconds
+	referrer    string
+	agent       clicks.AgentClass
+}
+
+//add appends clicks to raw clicks of their short IDs. Caller must hold storageLock
+func (c clicksT) add(batch []clicks.Click) {
+	for _, click := range batch {
+		c[click.ShortID] = append(c[click.ShortID], click)
+	}
+}
+
+//purge removes raw clicks before time. Caller must hold storageLock
+func (c clicksT) purge(before time.Time) {
+	for shortID, linkClicks := range c {
+		kept := linkClicks[:0]
+		for _, click := range linkClicks {
+			if !click.Time.Before(before) {
+				kept = append(kept, click)
+			}
+		}
+		if len(kept) == 0 {
+			delete(c, shortID)
+			continue
+		}
+		c[shortID] = kept
+	}
+}
+
+//add adds rollup rows to counts. Caller must hold storageLock
+func (ro rollupsT) add(rows []clicks.RollupRow) {
+	for _, row := range rows {
+		counts, ok := ro[row.ShortID]
+		if !ok {
+			counts = make(map[rollupKey]int64)
+			ro[row.ShortID] = counts
+		}
+		counts[rollupKey{row.Granularity, row.Start.UnixNano(), row.Referrer, row.Agent}] += row.Clicks
+	}
+}
+
+//linkRows returns rollup rows of short ID
+func (ro rollupsT) linkRows(shortID string) []clicks.RollupRow {
+	rows := make([]clicks.RollupRow, 0, len(ro[shortID]))
+	for k, n := range ro[shortID] {
+		rows = append(rows, clicks.RollupRow{
+			ShortID:     shortID,
+			Granularity: k.granularity,
+			Start:       time.Unix(0, k.start).UTC(),
+			Referrer:    k.referrer,
+			Agent:       k.agent,
+			Clicks:      n,
+		})
+	}
+	return rows
+}
+
+//rows returns all rollup rows for snapshot
+func (ro rollupsT) rows() []clicks.RollupRow {
+	rows := make([]clicks.RollupRow, 0, len(ro))
+	for shortID := range ro {
+		rows = append(rows, ro.linkRows(shortID)...)
+	}
+	return rows
+}
+
+//total returns number of all clicks of short ID by daily rollups
+func (ro rollupsT) total(shortID string) int64 {
+	var n int64
+	for k, clicksN := range ro[shortID] {
+		if k.granularity == clicks.Day {
+			n += clicksN
+		}
+	}
+	return n
+}
+
+//AddClicks appends batch of clicks to storage file as one record and adds them to raw clicks and rollups
+func (r *Repository) AddClicks(_ context.Context, batch []clicks.Click) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+	return r.commit(logRecord{Op: opClicks, Clicks: batch})
+}
+
+//ClickStats returns statistics of one short link, aggregated in memory over its rollups or raw clicks.
+//Total is counted by daily rollups, so it includes purged raw clicks
+func (r *Repository) ClickStats(_ context.Context, q clicks.Query) (clicks.Stats, error) {
+	r.storageLock.RLock()
+	defer r.storageLock.RUnlock()
+	stats := clicks.NewStats(q)
+	if q.FromRollups {
+		for _, row := range r.rollups.linkRows(q.ShortID) {
+			stats.AddRollup(row)
+		}
+	} else {
+		for _, c := range r.clicks[q.ShortID] {
+			stats.Add(c)
+		}
+	}
+	stats.Total = r.rollups.total(q.ShortID)
+	return stats, nil
+}
+
+//PurgeClicks deletes raw clicks before time. Purge is written to storage file, rollups are kept
+func (r *Repository) PurgeClicks(_ context.Context, before time.Time) (int64, error) {
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+
+	var n int64
+	for _, linkClicks := range r.clicks {
+		for _, c := range linkClicks {
+			if c.Time.Before(before) {
+				n++
+			}
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, r.commit(logRecord{Op: opPurge, Before: &before})
+}
@@ -0,0 +1,223 @@
+package repository
+
+import (
+	"github.com/antonevtu/go_shortener_adv/internal/clicks"
+	"github.com/antonevtu/go_shortener_adv/internal/db"
+	"github.com/antonevtu/go_shortener_adv/internal/pool"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+//compactorT triggers background compaction when storage file grows by threshold since last snapshot
+type compactorT struct {
+	maxBytes    int64
+	maxRecords  int
+	baseSize    int64
+	baseRecords int
+	trigger     chan struct{}
+	done        chan struct{}
+	wg          sync.WaitGroup
+	running     sync.Mutex // serializes compactions
+}
+
+//WithCompaction enables background compaction of storage file, when it grows
+//by maxBytes or by maxRecords since last snapshot. Zero value disables threshold
+func WithCompaction(maxBytes int64, maxRecords int) Option {
+	return func(r *Repository) {
+		r.compactor.maxBytes = maxBytes
+		r.compactor.maxRecords = maxRecords
+	}
+}
+
+func (c *compactorT) start(r *Repository) {
+	if c.maxBytes <= 0 && c.maxRecords <= 0 {
+		return
+	}
+	c.trigger = make(chan struct{}, 1)
+	c.done = make(chan struct{})
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		for {
+			select {
+			case <-c.trigger:
+				if err := r.Compact(); err != nil {
+					log.Println("storage compaction error:", err)
+				}
+			case <-c.done:
+				return
+			}
+		}
+	}()
+
+	// restored file may already exceed threshold
+	c.check(&r.fileWriter)
+}
+
+//check signals background goroutine if file has grown by threshold. Caller must hold writeLock
+func (c *compactorT) check(fw *fileWriterT) {
+	if c.trigger == nil {
+		return
+	}
+	if (c.maxBytes > 0 && fw.size-c.baseSize >= c.maxBytes) ||
+		(c.maxRecords > 0 && fw.records-c.baseRecords >= c.maxRecords) {
+		select {
+		case c.trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (c *compactorT) stop() {
+	if c.done == nil {
+		return
+	}
+	close(c.done)
+	c.wg.Wait()
+}
+
+//Compact rewrites storage file as snapshot of live entities, pending journal items, click rollups and raw clicks.
+//State is copied under writeLock, but snapshot is written to temporary file without it, so writes go on.
+//Then writeLock is taken again to append records written meanwhile, and temporary file atomically
+//replaces storage file and becomes new append target. Readers are not blocked during compaction
+func (r *Repository) Compact() error {
+	r.compactor.running.Lock()
+	defer r.compactor.running.Unlock()
+
+	r.writeLock.Lock()
+	if !r.persistent() {
+		r.writeLock.Unlock()
+		return nil
+	}
+	state := r.snapshot()
+	r.writeLock.Unlock()
+
+	tmpName := r.fileName + ".tmp"
+	tmp, err := os.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0777)
+	if err != nil {
+		return err
+	}
+	snapshot := fileWriterT{file: tmp}
+	err = state.write(&snapshot)
+	if err == nil {
+		// most of data is flushed before writes are stopped
+		err = tmp.Sync()
+	}
+	if err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmpName)
+		return err
+	}
+
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+	err = r.copyTail(&snapshot, state.size, state.records)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpName, r.fileName)
+	}
+	if err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmpName)
+		return err
+	}
+	syncDir(filepath.Dir(r.fileName))
+
+	_ = r.fileWriter.file.Close()
+	r.fileWriter = snapshot
+	r.compactor.baseSize = snapshot.size
+	r.compactor.baseRecords = snapshot.records
+	return nil
+}
+
+//stateT is copy of repository state for snapshot and size of storage file, which it corresponds to
+type stateT struct {
+	entities []db.Entity
+	jobs     []pool.ToDeleteItem
+	rollups  []clicks.RollupRow
+	clicks   [][]clicks.Click
+	size     int64
+	records  int
+}
+
+//snapshot copies repository state. Caller must hold writeLock
+func (r *Repository) snapshot() stateT {
+	state := stateT{
+		entities: make([]db.Entity, 0, len(r.storage)),
+		size:     r.fileWriter.size,
+		records:  r.fileWriter.records,
+	}
+	for _, entity := range r.storage {
+		state.entities = append(state.entities, entity)
+	}
+	if len(r.journal.pending) > 0 {
+		state.jobs = r.journal.items()
+	}
+	if len(r.rollups) > 0 {
+		state.rollups = r.rollups.rows()
+	}
+	for _, linkClicks := range r.clicks {
+		state.clicks = append(state.clicks, append([]clicks.Click(nil), linkClicks...))
+	}
+	return state
+}
+
+//write writes state records to file
+func (s stateT) write(fw *fileWriterT) error {
+	for _, entity := range s.entities {
+		if err := fw.write(logRecord{Op: opAdd, Entity: entity}); err != nil {
+			return err
+		}
+	}
+	if len(s.jobs) > 0 {
+		if err := fw.write(logRecord{Op: opEnqueue, Jobs: s.jobs}); err != nil {
+			return err
+		}
+	}
+	if len(s.rollups) > 0 {
+		if err := fw.write(logRecord{Op: opRollups, Rollups: s.rollups}); err != nil {
+			return err
+		}
+	}
+	for _, linkClicks := range s.clicks {
+		if err := fw.write(logRecord{Op: opRawClicks, Clicks: linkClicks}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//copyTail appends records of storage file written after its size was from to snapshot file.
+//Records are replayed after snapshot, as they were after copied state. Caller must hold writeLock
+func (r *Repository) copyTail(snapshot *fileWriterT, from int64, records int) error {
+	if r.fileWriter.size == from {
+		return nil
+	}
+	file, err := os.Open(r.fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	n, err := io.Copy(snapshot.file, io.NewSectionReader(file, from, r.fileWriter.size-from))
+	if err != nil {
+		return err
+	}
+	snapshot.size += n
+	snapshot.records += r.fileWriter.records - records
+	return nil
+}
+
+//syncDir makes rename durable
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	_ = d.Sync()
+	_ = d.Close()
+}
@@ -0,0 +1,49 @@
+package repository
+
+import (
+	"context"
+	"github.com/antonevtu/go_shortener_adv/internal/pool"
+	"sort"
+)
+
+//AppendDeletes writes accepted deletions to storage file as one enqueue record and sets their IDs.
+//Record is synced to disk before return under any sync policy
+func (r *Repository) AppendDeletes(_ context.Context, items []pool.ToDeleteItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+
+	for i := range items {
+		items[i].ID = r.journal.lastID + int64(i) + 1
+	}
+	return r.commit(logRecord{Op: opEnqueue, Jobs: items})
+}
+
+//AckDeletes writes processed deletions to storage file as one ack record
+func (r *Repository) AckDeletes(_ context.Context, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+	return r.commit(logRecord{Op: opAck, Acks: ids})
+}
+
+//PendingDeletes returns accepted, but not processed deletions, restored from storage file
+func (r *Repository) PendingDeletes(_ context.Context) ([]pool.ToDeleteItem, error) {
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+	return r.journal.items(), nil
+}
+
+//items returns pending deletions ordered by ID. Caller must hold writeLock
+func (j *journalT) items() []pool.ToDeleteItem {
+	items := make([]pool.ToDeleteItem, 0, len(j.pending))
+	for _, item := range j.pending {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(a, b int) bool { return items[a].ID < items[b].ID })
+	return items
+}
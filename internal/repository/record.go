@@ -0,0 +1,107 @@
+package repository
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/antonevtu/go_shortener_adv/internal/clicks"
+	"github.com/antonevtu/go_shortener_adv/internal/db"
+	"github.com/antonevtu/go_shortener_adv/internal/pool"
+	"hash/crc32"
+	"strconv"
+	"time"
+)
+
+//Operations of storage file records. Empty operation is a single added Entity
+//and keeps compatibility with files written before operations were introduced
+const (
+	opAdd       = ""
+	opBatch     = "batch"
+	opDelete    = "delete"
+	opEnqueue   = "enqueue"    // accepted deletions of deleter pool journal
+	opAck       = "ack"        // processed deletions of deleter pool journal
+	opClicks    = "clicks"     // redirects of short links, added to raw clicks and rollups
+	opRawClicks = "raw_clicks" // raw clicks of snapshot, already counted in its rollups
+	opRollups   = "rollups"    // rollups of snapshot
+	opPurge     = "purge"      // retention of raw clicks
+)
+
+//recordVersion is version of checksummed line format.
+//Lines without version are plain JSON records of older files
+const recordVersion = 1
+
+var errTornRecord = errors.New("torn record")
+
+//logRecord is one line of storage file.
+//Delete record is a tombstone: its batch carries user ID and short ID of soft-deleted entities.
+//Enqueue and ack records are deleter pool journal
+type logRecord struct {
+	Op string `json:"op,omitempty"`
+	db.Entity
+	Batch   []db.Entity         `json:"batch,omitempty"`
+	Jobs    []pool.ToDeleteItem `json:"jobs,omitempty"`
+	Acks    []int64             `json:"acks,omitempty"`
+	Clicks  []clicks.Click      `json:"clicks,omitempty"`
+	Rollups []clicks.RollupRow  `json:"rollups,omitempty"`
+	Before  *time.Time          `json:"before,omitempty"`
+}
+
+//envelopeT is versioned line format: record with CRC-32 checksum of its exact JSON bytes
+type envelopeT struct {
+	V   int             `json:"v"`
+	CRC uint32          `json:"crc"`
+	Rec json.RawMessage `json:"rec"`
+}
+
+//entities returns all entities, carried by record
+func (rec logRecord) entities() []db.Entity {
+	if rec.Op == opAdd {
+		return []db.Entity{rec.Entity}
+	}
+	return rec.Batch
+}
+
+//encodeRecord returns one storage file line in current format, including trailing newline
+func encodeRecord(rec logRecord) ([]byte, error) {
+	data, err := json.Marshal(&rec)
+	if err != nil {
+		return nil, err
+	}
+	line := make([]byte, 0, len(data)+40)
+	line = append(line, `{"v":`...)
+	line = strconv.AppendInt(line, recordVersion, 10)
+	line = append(line, `,"crc":`...)
+	line = strconv.AppendUint(line, uint64(crc32.ChecksumIEEE(data)), 10)
+	line = append(line, `,"rec":`...)
+	line = append(line, data...)
+	line = append(line, "}\n"...)
+	return line, nil
+}
+
+//decodeRecord parses one storage file line in current or plain JSON format.
+//Line without trailing newline is considered torn by interrupted write
+func decodeRecord(line []byte) (logRecord, error) {
+	rec := logRecord{}
+	if !bytes.HasSuffix(line, []byte("\n")) {
+		return rec, errTornRecord
+	}
+
+	envelope := envelopeT{}
+	err := json.Unmarshal(line, &envelope)
+	if err != nil {
+		return rec, err
+	}
+	switch envelope.V {
+	case 0:
+		err = json.Unmarshal(line, &rec)
+	case recordVersion:
+		if crc32.ChecksumIEEE(envelope.Rec) != envelope.CRC {
+			return rec, errors.New("checksum mismatch")
+		}
+		err = json.Unmarshal(envelope.Rec, &rec)
+	default:
+		err = fmt.Errorf("unknown record version %d", envelope.V)
+	}
+	return rec, err
+}
@@ -1,50 +1,116 @@
 //Package repository implements in-memory entity storage
-//Implements handlers.Repositorier interface, but some methods not supported (because this is education application)
-//Storage has backup in text file cfgApp.FileStoragePath
+//Implements handlers.Repositorier interface, but Ping not supported (because this is education application)
+//Storage has backup in text file cfgApp.FileStoragePath. Empty file path means ephemeral map-only storage
 package repository
 
 import (
+	"bufio"
+	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/antonevtu/go_shortener_adv/internal/clicks"
 	"github.com/antonevtu/go_shortener_adv/internal/db"
 	"github.com/antonevtu/go_shortener_adv/internal/pool"
 	"io"
+	"log"
 	"os"
 	"sync"
+	"time"
 )
 
-//Repository is in-memory repository, based on map, with backup file writer for new records
+//Repository is in-memory repository, based on map, with backup file writer for new records.
+//writeLock serializes all modifications and file operations, so writers may read maps without storageLock.
+//storageLock guards maps against readers only while a committed record is applied,
+//so redirects don't wait for file writes and don't block each other
 type Repository struct {
 	storage     storageT
-	storageLock sync.Mutex
+	longIndex   longIndexT
+	userIndex   userIndexT
+	storageLock sync.RWMutex
+	writeLock   sync.Mutex
+	fileName    string
 	fileWriter  fileWriterT
+	compactor   compactorT
+	syncer      syncerT
+	journal     journalT
+	clicks      clicksT
+	rollups     rollupsT
 }
 
 type storageT map[string]db.Entity
 
+//longIndexT is reverse index long URL -> short ID
+type longIndexT map[string]string
+
+//userIndexT is secondary index user ID -> short IDs
+type userIndexT map[string][]string
+
+//clicksT is raw redirects by short ID
+type clicksT map[string][]clicks.Click
+
+//rollupsT is hourly and daily numbers of redirects by short ID
+type rollupsT map[string]map[rollupKey]int64
+
+//journalT is deleter pool journal: pending deletions by ID
+type journalT struct {
+	pending map[int64]pool.ToDeleteItem
+	lastID  int64
+}
+
 type fileWriterT struct {
 	file    *os.File
-	encoder *json.Encoder
+	size    int64 // bytes in file
+	records int   // records in file
 }
 
-//New returns new in-memory repository, restored from text file
-func New(fileName string) (*Repository, error) {
-	repository := Repository{
+//Option configures Repository in New
+type Option func(r *Repository)
+
+//New returns new in-memory repository, restored from text file.
+//If fileName is empty, repository is ephemeral: nothing is read or written to disk
+func New(fileName string, opts ...Option) (*Repository, error) {
+	repository := &Repository{
 		storage:    make(storageT, 100),
+		longIndex:  make(longIndexT, 100),
+		userIndex:  make(userIndexT, 100),
+		fileName:   fileName,
 		fileWriter: fileWriterT{},
+		syncer:     syncerT{policy: SyncNever},
+		journal:    journalT{pending: make(map[int64]pool.ToDeleteItem)},
+		clicks:     make(clicksT),
+		rollups:    make(rollupsT),
+	}
+	for _, opt := range opts {
+		opt(repository)
+	}
+	if !repository.persistent() {
+		return repository, nil
 	}
 
-	err := repository.restoreFromFile(fileName)
+	records, err := repository.restoreFromFile(fileName)
 	if err != nil {
-		return &repository, err
+		return repository, err
 	}
 
 	err = repository.fileWriter.new(fileName)
 	if err != nil {
-		return &repository, err
+		return repository, err
+	}
+	repository.fileWriter.records = records
+
+	err = repository.syncer.start(repository)
+	if err != nil {
+		_ = repository.fileWriter.file.Close()
+		return repository, err
 	}
-	return &repository, nil
+	repository.compactor.start(repository)
+	return repository, nil
+}
+
+//persistent reports whether repository has backup file
+func (r *Repository) persistent() bool {
+	return r.fileName != ""
 }
 
 func (fw *fileWriterT) new(filename string) error {
@@ -52,83 +118,381 @@ func (fw *fileWriterT) new(filename string) error {
 	if err != nil {
 		return err
 	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
 	*fw = fileWriterT{
-		file:    file,
-		encoder: json.NewEncoder(file),
+		file: file,
+		size: info.Size(),
 	}
 	return nil
 }
 
-func (r *Repository) restoreFromFile(fileName string) error {
-	file, err := os.OpenFile(fileName, os.O_RDONLY|os.O_CREATE, 0777)
+//write appends one record line to file.
+//Partially written line is truncated, so next records don't follow torn one
+func (fw *fileWriterT) write(rec logRecord) error {
+	line, err := encodeRecord(rec)
+	if err != nil {
+		return err
+	}
+	n, err := fw.file.Write(line)
 	if err != nil {
+		if n > 0 {
+			if truncErr := fw.truncate(fw.size); truncErr != nil {
+				return fmt.Errorf("%w; can't truncate torn record: %v", err, truncErr)
+			}
+		}
+		return err
+	}
+	fw.size += int64(n)
+	fw.records++
+	return nil
+}
+
+//truncate cuts file to size and moves write offset there
+func (fw *fileWriterT) truncate(size int64) error {
+	if err := fw.file.Truncate(size); err != nil {
 		return err
 	}
+	_, err := fw.file.Seek(size, io.SeekStart)
+	return err
+}
+
+//restoreFromFile replays storage file and returns number of records in it.
+//Corrupted tail of file (torn by crash or with wrong checksum) is truncated with warning.
+//Corrupted record followed by valid ones is an error
+func (r *Repository) restoreFromFile(fileName string) (int, error) {
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0777)
+	if err != nil {
+		return 0, err
+	}
 	defer file.Close()
-	decoder := json.NewDecoder(file)
-	entity := db.Entity{}
+
+	reader := bufio.NewReader(file)
+	records := 0
+	var offset, badOffset int64 = 0, -1
+	var badErr error
 	for {
-		err = decoder.Decode(&entity)
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			rec, decodeErr := decodeRecord(line)
+			switch {
+			case decodeErr != nil && badOffset < 0:
+				badOffset, badErr = offset, decodeErr
+			case decodeErr == nil && badOffset >= 0:
+				return records, fmt.Errorf("storage file %s corrupted at offset %d: %w", fileName, badOffset, badErr)
+			case decodeErr == nil:
+				r.apply(rec)
+				records++
+			}
+		}
+		offset += int64(len(line))
 		if err == io.EOF {
-			return nil
+			break
 		} else if err != nil {
-			return err
+			return records, err
+		}
+	}
+
+	if badOffset >= 0 {
+		log.Printf("warning: storage file %s has corrupted tail at offset %d (%v), %d bytes truncated",
+			fileName, badOffset, badErr, offset-badOffset)
+		err = file.Truncate(badOffset)
+		if err != nil {
+			return records, err
 		}
-		r.storage[entity.ShortID] = entity
 	}
+	return records, nil
 }
 
-func (r *Repository) AddEntity(_ context.Context, entity db.Entity) error {
+//commit writes record to storage file and applies it to map.
+//Enqueue record is synced to disk before return whatever sync policy is.
+//Record, which failed to sync, is truncated from file and not applied. Caller must hold writeLock
+func (r *Repository) commit(rec logRecord) error {
+	if r.persistent() {
+		size, records := r.fileWriter.size, r.fileWriter.records
+		err := r.fileWriter.write(rec)
+		if err != nil {
+			return err
+		}
+		err = r.syncer.written(&r.fileWriter, rec.Op == opEnqueue)
+		if err != nil {
+			// record isn't reported committed, so it mustn't be replayed after restart
+			if truncErr := r.fileWriter.truncate(size); truncErr != nil {
+				// record stays in file, memory follows it
+				r.storageLock.Lock()
+				r.apply(rec)
+				r.storageLock.Unlock()
+				return fmt.Errorf("%w; can't truncate not synced record: %v", err, truncErr)
+			}
+			r.fileWriter.size, r.fileWriter.records = size, records
+			return err
+		}
+	}
 	r.storageLock.Lock()
-	defer r.storageLock.Unlock()
+	r.apply(rec)
+	r.storageLock.Unlock()
+	r.compactor.check(&r.fileWriter)
+	return nil
+}
+
+//apply replays one storage file record. Caller must hold writeLock and storageLock
+func (r *Repository) apply(rec logRecord) {
+	switch rec.Op {
+	case opAdd, opBatch:
+		for _, entity := range rec.entities() {
+			r.put(entity)
+		}
+	case opDelete:
+		for _, tombstone := range rec.entities() {
+			if entity, ok := r.storage[tombstone.ShortID]; ok && entity.UserID == tombstone.UserID {
+				entity.Deleted = true
+				r.storage[entity.ShortID] = entity
+			}
+		}
+	case opEnqueue:
+		for _, item := range rec.Jobs {
+			r.journal.pending[item.ID] = item
+			if item.ID > r.journal.lastID {
+				r.journal.lastID = item.ID
+			}
+		}
+	case opAck:
+		for _, id := range rec.Acks {
+			delete(r.journal.pending, id)
+		}
+	case opClicks:
+		r.clicks.add(rec.Clicks)
+		r.rollups.add(clicks.Rollup(rec.Clicks))
+	case opRawClicks:
+		r.clicks.add(rec.Clicks)
+	case opRollups:
+		r.rollups.add(rec.Rollups)
+	case opPurge:
+		if rec.Before != nil {
+			r.clicks.purge(*rec.Before)
+		}
+	}
+}
+
+//put stores entity in map and keeps indexes in sync.
+//Deleted or expired entity of the same long URL stays in map, long URL index points to the newer one.
+//Caller must hold writeLock and storageLock
+func (r *Repository) put(entity db.Entity) {
+	if _, ok := r.storage[entity.ShortID]; !ok {
+		r.userIndex[entity.UserID] = append(r.userIndex[entity.UserID], entity.ShortID)
+	}
 	r.storage[entity.ShortID] = entity
-	err := r.fileWriter.encoder.Encode(&entity)
-	return err
+	if shortID, ok := r.longIndex[entity.LongURL]; !ok || shortID == entity.ShortID || newer(entity, r.storage[shortID]) {
+		r.longIndex[entity.LongURL] = entity.ShortID
+	}
 }
 
-func (r *Repository) SelectByLongURL(_ context.Context, id string) (db.Entity, error) {
-	return db.Entity{}, errors.New("method not supported")
+//newer reports whether entity was added after other entity of the same long URL.
+//Entity of long URL may be added only when previous one is dead, so not deleted entity is newer than deleted one,
+//and of two not deleted entities the later expiring one is newer. Snapshot of compaction is restored in any order
+func newer(entity, other db.Entity) bool {
+	switch {
+	case entity.Deleted != other.Deleted:
+		return !entity.Deleted
+	case entity.Deleted:
+		return true
+	case other.ExpiresAt == nil:
+		return false
+	case entity.ExpiresAt == nil:
+		return true
+	default:
+		return entity.ExpiresAt.After(*other.ExpiresAt)
+	}
+}
+
+//live returns entity of long URL, if it is neither deleted nor expired. Caller must hold writeLock
+func (r *Repository) live(longURL string, now time.Time) (db.Entity, bool) {
+	shortID, ok := r.longIndex[longURL]
+	if !ok {
+		return db.Entity{}, false
+	}
+	entity := r.storage[shortID]
+	return entity, !entity.Deleted && !entity.Expired(now)
+}
+
+//AddEntity adds new Entity. If live entity of long URL already exists, returns db.ErrUniqueViolation.
+//Deleted or expired entity of the same long URL is kept under its short ID
+func (r *Repository) AddEntity(_ context.Context, entity db.Entity) error {
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+	if _, ok := r.live(entity.LongURL, time.Now()); ok {
+		return db.ErrUniqueViolation
+	}
+	if _, ok := r.storage[entity.ShortID]; ok {
+		return db.ErrShortIDConflict
+	}
+	rec := logRecord{Op: opAdd, Entity: entity}
+	return r.commit(rec)
+}
+
+//AddOrGetEntity adds new Entity or returns existing live Entity with the same long URL.
+//Deleted or expired entity of the same long URL is kept, new one is added under new short ID.
+//created is false if entity already existed. If short ID is taken, returns db.ErrShortIDConflict
+func (r *Repository) AddOrGetEntity(_ context.Context, entity db.Entity) (db.Entity, bool, error) {
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+	if e, ok := r.live(entity.LongURL, time.Now()); ok {
+		return e, false, nil
+	}
+	if _, ok := r.storage[entity.ShortID]; ok {
+		return db.Entity{}, false, db.ErrShortIDConflict
+	}
+	rec := logRecord{Op: opAdd, Entity: entity}
+	return entity, true, r.commit(rec)
+}
+
+//SelectByLongURL returns Entity for known long URL
+func (r *Repository) SelectByLongURL(_ context.Context, longURL string) (db.Entity, error) {
+	r.storageLock.RLock()
+	defer r.storageLock.RUnlock()
+	shortID, ok := r.longIndex[longURL]
+	if !ok {
+		return db.Entity{}, fmt.Errorf("a non-existent long URL was requested: %w", db.ErrNotFound)
+	}
+	return r.storage[shortID], nil
 }
 
 func (r *Repository) SelectByShortID(_ context.Context, id string) (db.Entity, error) {
-	r.storageLock.Lock()
-	defer r.storageLock.Unlock()
+	r.storageLock.RLock()
+	defer r.storageLock.RUnlock()
 	entity, ok := r.storage[id]
 	if ok {
 		return entity, nil
 	} else {
-		return db.Entity{}, errors.New("a non-existent ID was requested")
+		return db.Entity{}, fmt.Errorf("a non-existent ID was requested: %w", db.ErrNotFound)
 	}
 }
 
+//SelectByUser returns all Entities of given userID, using user index
 func (r *Repository) SelectByUser(_ context.Context, userID string) ([]db.Entity, error) {
-	r.storageLock.Lock()
-	defer r.storageLock.Unlock()
-	selection := make([]db.Entity, 0, 10)
-	for _, entity := range r.storage {
-		if userID == entity.UserID {
-			selection = append(selection, entity)
-		}
+	r.storageLock.RLock()
+	defer r.storageLock.RUnlock()
+	shortIDs := r.userIndex[userID]
+	selection := make([]db.Entity, 0, len(shortIDs))
+	for _, shortID := range shortIDs {
+		selection = append(selection, r.storage[shortID])
 	}
 	return selection, nil
 }
 
 func (r *Repository) Close() {
+	if !r.persistent() {
+		return
+	}
+	r.compactor.stop()
+	r.syncer.stop()
+	// manual compaction writes snapshot without writeLock
+	r.compactor.running.Lock()
+	defer r.compactor.running.Unlock()
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+	_ = r.syncer.flush(&r.fileWriter)
 	_ = r.fileWriter.file.Close()
 }
 
-func (r *Repository) AddEntityBatch(_ context.Context, _ string, _ db.BatchInput) error {
-	return errors.New("batches not supported")
+//AddEntityBatch adds BatchInput. Items with status db.BatchInvalid are skipped.
+//Other items get status db.BatchCreated or db.BatchExists, ShortID of already existing long URL
+//(stored earlier or repeated in batch) is replaced by stored one. Deleted or expired entities are kept, new ones are added.
+//Item with alias, taken by other entity, gets status db.BatchAliasTaken and is not stored.
+//If generated short ID of any new item is taken, nothing is added and db.ErrShortIDConflict returned.
+//New entities are written to storage file as one record, so batch is restored either fully or not at all
+func (r *Repository) AddEntityBatch(_ context.Context, userID string, input db.BatchInput) error {
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+
+	rec := logRecord{Op: opBatch, Batch: make([]db.Entity, 0, len(input))}
+	inBatch := make(map[string]string, len(input))
+	newIDs := make(map[string]struct{}, len(input))
+	now := time.Now()
+	for i, v := range input {
+		if v.Status == db.BatchInvalid {
+			continue
+		}
+		if e, ok := r.live(v.OriginalURL, now); ok {
+			input[i].ShortID, input[i].Status = e.ShortID, db.BatchExists
+			continue
+		}
+		if shortID, ok := inBatch[v.OriginalURL]; ok {
+			input[i].ShortID, input[i].Status = shortID, db.BatchExists
+			continue
+		}
+		_, stored := r.storage[v.ShortID]
+		_, repeated := newIDs[v.ShortID]
+		if (stored || repeated) && v.Alias != "" {
+			input[i].Status = db.BatchAliasTaken
+			continue
+		}
+		if stored || repeated {
+			return db.ErrShortIDConflict
+		}
+		newIDs[v.ShortID] = struct{}{}
+		inBatch[v.OriginalURL] = v.ShortID
+		input[i].Status = db.BatchCreated
+		rec.Batch = append(rec.Batch, db.Entity{Deleted: v.Deleted, UserID: userID, ShortID: v.ShortID, LongURL: v.OriginalURL, ExpiresAt: v.ExpiresAt})
+	}
+	if len(rec.Batch) == 0 {
+		return nil
+	}
+
+	return r.commit(rec)
 }
 
 func (r *Repository) Ping(_ context.Context) error {
 	return errors.New("ping not supported")
 }
 
-func (r *Repository) SetDeletedBatch(ctx context.Context, userID string, shortIDs []string) error {
-	return errors.New("method not supported")
+//SetDeletedBatch sets deleted flag for several Entities of given user.
+//Tombstone record is appended to storage file, so deleted Entities stay deleted after restore.
+//Returns short IDs, which belong to user and are deleted now; already deleted ones are not returned
+func (r *Repository) SetDeletedBatch(_ context.Context, userID string, shortIDs []string) ([]string, error) {
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+
+	deleted := make([]string, 0, len(shortIDs))
+	rec := logRecord{Op: opDelete, Batch: make([]db.Entity, 0, len(shortIDs))}
+	for _, shortID := range shortIDs {
+		entity, ok := r.storage[shortID]
+		if !ok || entity.UserID != userID || entity.Deleted {
+			continue
+		}
+		deleted = append(deleted, shortID)
+		rec.Batch = append(rec.Batch, db.Entity{Deleted: true, UserID: userID, ShortID: shortID})
+	}
+	if len(rec.Batch) == 0 {
+		return deleted, nil
+	}
+
+	return deleted, r.commit(rec)
+}
+
+//DeleteExpired sets deleted flag for all not deleted Entities with expiration time not after now.
+//Deletion is written to storage file as one tombstone record. Returns number of deleted Entities
+func (r *Repository) DeleteExpired(_ context.Context, now time.Time) (int64, error) {
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+
+	rec := logRecord{Op: opDelete}
+	for _, entity := range r.storage {
+		if !entity.Deleted && entity.Expired(now) {
+			rec.Batch = append(rec.Batch, db.Entity{Deleted: true, UserID: entity.UserID, ShortID: entity.ShortID})
+		}
+	}
+	if len(rec.Batch) == 0 {
+		return 0, nil
+	}
+	return int64(len(rec.Batch)), r.commit(rec)
 }
 
+//SetDeleted sets deleted flag for one Entity
 func (r *Repository) SetDeleted(ctx context.Context, item pool.ToDeleteItem) error {
-	return errors.New("method not supported")
+	_, err := r.SetDeletedBatch(ctx, item.UserID, []string{item.ShortID})
+	return err
 }
@@ -0,0 +1,109 @@
+package repository
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+//SyncPolicy defines, when storage file is flushed to disk with fsync.
+//Enqueue records of deleter pool journal are flushed under any policy,
+//as deletions are reported accepted only after they are persisted
+type SyncPolicy string
+
+const (
+	SyncAlways   SyncPolicy = "always"   // after every record
+	SyncInterval SyncPolicy = "interval" // periodically in background
+	SyncNever    SyncPolicy = "never"    // left to operating system
+)
+
+//syncerT flushes storage file according to SyncPolicy
+type syncerT struct {
+	policy   SyncPolicy
+	interval time.Duration
+	dirty    bool
+	syncFile func(file *os.File) error // (*os.File).Sync, if nil
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+//WithSync sets fsync policy of storage file. Interval is used by SyncInterval policy only
+func WithSync(policy SyncPolicy, interval time.Duration) Option {
+	return func(r *Repository) {
+		r.syncer.policy = policy
+		r.syncer.interval = interval
+	}
+}
+
+func (s *syncerT) start(r *Repository) error {
+	switch s.policy {
+	case SyncAlways, SyncNever:
+		return nil
+	case SyncInterval:
+		if s.interval <= 0 {
+			return fmt.Errorf("invalid sync interval %v", s.interval)
+		}
+	default:
+		return fmt.Errorf("unknown sync policy %q", s.policy)
+	}
+
+	s.done = make(chan struct{})
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.writeLock.Lock()
+				err := s.flush(&r.fileWriter)
+				r.writeLock.Unlock()
+				if err != nil {
+					log.Println("storage sync error:", err)
+				}
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+//written is called after record is written to file. durable record is flushed under any policy.
+//Caller must hold writeLock
+func (s *syncerT) written(fw *fileWriterT, durable bool) error {
+	s.dirty = true
+	if s.policy == SyncAlways || durable {
+		return s.flush(fw)
+	}
+	return nil
+}
+
+//flush syncs file if it has unsynced records. Caller must hold writeLock
+func (s *syncerT) flush(fw *fileWriterT) error {
+	if !s.dirty {
+		return nil
+	}
+	var err error
+	if s.syncFile != nil {
+		err = s.syncFile(fw.file)
+	} else {
+		err = fw.file.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+func (s *syncerT) stop() {
+	if s.done == nil {
+		return
+	}
+	close(s.done)
+	s.wg.Wait()
+}
@@ -0,0 +1,49 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/antonevtu/go_shortener_adv/internal/db"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// запись, которую не удалось синхронизировать, не применяется и удаляется из файла
+func TestSyncFailure(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "storage.txt")
+	repo, err := New(fileName, WithSync(SyncAlways, 0))
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	errSync := errors.New("fsync failed")
+	repo.syncer.syncFile = func(*os.File) error { return errSync }
+	err = repo.AddEntity(ctx, db.Entity{UserID: "u", ShortID: "lost", LongURL: "https://yandex.ru/lost"})
+	require.ErrorIs(t, err, errSync)
+	_, err = repo.SelectByShortID(ctx, "lost")
+	require.ErrorIs(t, err, db.ErrNotFound)
+	data, err := os.ReadFile(fileName)
+	require.NoError(t, err)
+	require.Empty(t, data)
+
+	// следующие записи пишутся с начала файла
+	repo.syncer.syncFile = nil
+	err = repo.AddEntity(ctx, db.Entity{UserID: "u", ShortID: "kept", LongURL: "https://yandex.ru/lost"})
+	require.NoError(t, err)
+	data, err = os.ReadFile(fileName)
+	require.NoError(t, err)
+	require.Equal(t, 1, bytes.Count(data, []byte("\n")))
+	repo.Close()
+
+	// после перезапуска память совпадает с файлом
+	repo, err = New(fileName)
+	require.NoError(t, err)
+	defer repo.Close()
+	_, err = repo.SelectByShortID(ctx, "lost")
+	require.ErrorIs(t, err, db.ErrNotFound)
+	e, err := repo.SelectByShortID(ctx, "kept")
+	require.NoError(t, err)
+	require.Equal(t, "https://yandex.ru/lost", e.LongURL)
+}
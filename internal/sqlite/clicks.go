@@ -0,0 +1,95 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"github.com/antonevtu/go_shortener_adv/internal/clicks"
+	"time"
+)
+
+//AddClicks stores batch of clicks in clicks table in one transaction
+func (t *T) AddClicks(ctx context.Context, batch []clicks.Click) error {
+	ctx = noInterrupt{ctx}
+	if len(batch) == 0 {
+		return nil
+	}
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, "insert into clicks (short_id, clicked_at, referrer, agent) values (?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, c := range batch {
+		if _, err = stmt.ExecContext(ctx, c.ShortID, c.Time.UnixNano(), c.Referrer, string(c.Agent)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+//ClickStats returns statistics of one short link, aggregated by database over clicks in range.
+//SQLite keeps no rollups and raw clicks are not purged, so statistics are always read from raw clicks
+func (t *T) ClickStats(ctx context.Context, q clicks.Query) (clicks.Stats, error) {
+	ctx = noInterrupt{ctx}
+	q.FromRollups = false
+	stats := clicks.NewStats(q)
+	err := t.read.QueryRowContext(ctx, "select count(*) from clicks where short_id = ?", q.ShortID).Scan(&stats.Total)
+	if err != nil || len(stats.Buckets) == 0 {
+		return stats, err
+	}
+
+	// clicked_at is in unix nanoseconds, so bucket is number of granularity periods from start of the first bucket
+	origin, width := stats.Buckets[0].Start.UnixNano(), int64(q.Bucket.Duration())
+	inRange := " from clicks where short_id = ? and clicked_at >= ? and clicked_at < ?"
+	from, to := q.From.UnixNano(), q.To.UnixNano()
+	err = t.scanCounts(ctx, "select (clicked_at - ?) / ?, count(*)"+inRange+" group by 1", []interface{}{origin, width, q.ShortID, from, to},
+		func(rows *sql.Rows) error {
+			var bucket, n int64
+			err := rows.Scan(&bucket, &n)
+			stats.AddBucket(time.Unix(0, origin+bucket*width).UTC(), n)
+			return err
+		})
+	if err != nil {
+		return stats, err
+	}
+	err = t.scanCounts(ctx, "select referrer, count(*)"+inRange+" group by referrer", []interface{}{q.ShortID, from, to},
+		func(rows *sql.Rows) error {
+			var referrer string
+			var n int64
+			err := rows.Scan(&referrer, &n)
+			stats.Referrers[referrer] = n
+			return err
+		})
+	if err != nil {
+		return stats, err
+	}
+	err = t.scanCounts(ctx, "select agent, count(*)"+inRange+" group by agent", []interface{}{q.ShortID, from, to},
+		func(rows *sql.Rows) error {
+			var agent string
+			var n int64
+			err := rows.Scan(&agent, &n)
+			stats.Agents[clicks.AgentClass(agent)] = n
+			return err
+		})
+	return stats, err
+}
+
+//scanCounts runs query and reads all its rows by scan
+func (t *T) scanCounts(ctx context.Context, query string, args []interface{}, scan func(rows *sql.Rows) error) error {
+	rows, err := t.read.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err = scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
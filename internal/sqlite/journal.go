@@ -0,0 +1,69 @@
+package sqlite
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/antonevtu/go_shortener_adv/internal/pool"
+)
+
+//AppendDeletes stores accepted deletions in delete_queue table in transaction mode and sets their IDs
+func (t *T) AppendDeletes(ctx context.Context, items []pool.ToDeleteItem) error {
+	ctx = noInterrupt{ctx}
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, "insert into delete_queue (user_id, short_id, job_id) values (?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for i, item := range items {
+		res, err := stmt.ExecContext(ctx, item.UserID, item.ShortID, item.JobID)
+		if err != nil {
+			return err
+		}
+		if items[i].ID, err = res.LastInsertId(); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("unable to commit: %w", err)
+	}
+	return nil
+}
+
+//AckDeletes removes processed deletions from delete_queue table
+func (t *T) AckDeletes(ctx context.Context, ids []int64) error {
+	ctx = noInterrupt{ctx}
+	data, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+	_, err = t.db.ExecContext(ctx, "delete from delete_queue where id in (select value from json_each(?))", string(data))
+	return err
+}
+
+//PendingDeletes returns not processed deletions from delete_queue table
+func (t *T) PendingDeletes(ctx context.Context) ([]pool.ToDeleteItem, error) {
+	ctx = noInterrupt{ctx}
+	rows, err := t.db.QueryContext(ctx, "select id, user_id, short_id, job_id from delete_queue order by id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := make([]pool.ToDeleteItem, 0, 10)
+	for rows.Next() {
+		var item pool.ToDeleteItem
+		if err = rows.Scan(&item.ID, &item.UserID, &item.ShortID, &item.JobID); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
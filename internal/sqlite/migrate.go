@@ -0,0 +1,128 @@
+package sqlite
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+//migration is one schema version with SQL for upgrade. SQLite schema is only upgraded
+type migration struct {
+	version int
+	name    string
+	up      string
+}
+
+//migrations returns embedded migrations ordered by version. Files are named NNNN_name.sql
+func migrations() ([]migration, error) {
+	files, err := fs.ReadDir(migrationsFS, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	list := make([]migration, 0, len(files))
+	for _, file := range files {
+		name := file.Name()
+		parts := strings.SplitN(strings.TrimSuffix(name, ".sql"), "_", 2)
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 || !strings.HasSuffix(name, ".sql") {
+			return nil, fmt.Errorf("invalid migration file name %s", name)
+		}
+		data, err := migrationsFS.ReadFile(path.Join("migrations", name))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, migration{version: version, name: parts[1], up: string(data)})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].version < list[j].version })
+	return list, nil
+}
+
+//migrateUp applies not applied migrations. Schema version is kept in user_version pragma.
+//Each migration runs with version update in its own transaction
+func (t *T) migrateUp(ctx context.Context) error {
+	list, err := migrations()
+	if err != nil {
+		return err
+	}
+	version, err := t.schemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	for _, m := range list {
+		if m.version <= version {
+			continue
+		}
+		if err = t.runMigration(ctx, m); err != nil {
+			return fmt.Errorf("migration %04d_%s: %w", m.version, m.name, err)
+		}
+	}
+	return nil
+}
+
+//schemaVersion returns version of applied migrations.
+//Database of service without migrations has zero version, but its tables were created by the first migration
+//and the later ones added columns, so its version is found by these columns
+func (t *T) schemaVersion(ctx context.Context) (int, error) {
+	var version int
+	if err := t.db.QueryRowContext(ctx, "pragma user_version").Scan(&version); err != nil || version > 0 {
+		return version, err
+	}
+
+	var n int
+	err := t.db.QueryRowContext(ctx, "select count(*) from sqlite_master where type = 'table' and name = 'urls'").Scan(&n)
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	legacy := []struct {
+		version       int
+		table, column string
+	}{
+		{2, "urls", "expires_at"},
+		{3, "delete_queue", "job_id"},
+	}
+	for _, l := range legacy {
+		err = t.db.QueryRowContext(ctx, "select count(*) from pragma_table_info(?) where name = ?", l.table, l.column).Scan(&n)
+		if err != nil || n == 0 {
+			break
+		}
+		version = l.version
+	}
+	if err != nil || version == 0 {
+		return 0, err
+	}
+
+	// the first migration is idempotent, it creates tables, which service had not created yet
+	list, err := migrations()
+	if err != nil {
+		return 0, err
+	}
+	if err = t.runMigration(ctx, migration{version: version, name: "legacy", up: list[0].up}); err != nil {
+		return 0, fmt.Errorf("migration of database without version: %w", err)
+	}
+	return version, nil
+}
+
+//runMigration executes migration script and sets schema version in one transaction
+func (t *T) runMigration(ctx context.Context, m migration) error {
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.ExecContext(ctx, m.up); err != nil {
+		return err
+	}
+	// pragma doesn't accept parameters
+	if _, err = tx.ExecContext(ctx, "pragma user_version = "+strconv.Itoa(m.version)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
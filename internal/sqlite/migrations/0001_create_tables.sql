@@ -0,0 +1,22 @@
+-- databases, created before migrations were introduced, already have these tables
+create table if not exists urls (
+    id integer primary key autoincrement,
+    deleted boolean not null,
+    user_id text not null,
+    short_id text not null unique,
+    long_url text not null unique
+);
+create index if not exists urls_user_id on urls (user_id);
+create table if not exists delete_queue (
+    id integer primary key autoincrement,
+    user_id text not null,
+    short_id text not null
+);
+create table if not exists clicks (
+    id integer primary key autoincrement,
+    short_id text not null,
+    clicked_at integer not null, -- unix nanoseconds
+    referrer text not null,
+    agent text not null
+);
+create index if not exists clicks_short_id_clicked_at on clicks (short_id, clicked_at);
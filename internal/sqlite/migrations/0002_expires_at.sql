@@ -0,0 +1,2 @@
+-- unix seconds, null for links without expiration
+alter table urls add column expires_at integer;
@@ -0,0 +1,16 @@
+-- deleted links keep their rows and short IDs, so long URL is unique only among not deleted links.
+-- SQLite can't drop column constraint, so table is rebuilt
+create table urls_live (
+    id integer primary key autoincrement,
+    deleted boolean not null,
+    user_id text not null,
+    short_id text not null unique,
+    long_url text not null,
+    expires_at integer -- unix seconds, null for links without expiration
+);
+insert into urls_live (id, deleted, user_id, short_id, long_url, expires_at)
+    select id, deleted, user_id, short_id, long_url, expires_at from urls;
+drop table urls;
+alter table urls_live rename to urls;
+create index urls_user_id on urls (user_id);
+create unique index urls_long_url_live on urls (long_url) where not deleted;
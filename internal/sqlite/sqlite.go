@@ -0,0 +1,355 @@
+// Package sqlite implements handlers.Repositorier interface for store short URL in embedded single-file SQLite database.
+// Driver is pure Go, so no cgo and no external services are required
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/antonevtu/go_shortener_adv/internal/db"
+	"github.com/antonevtu/go_shortener_adv/internal/pool"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+	"net/url"
+	"time"
+)
+
+//T keeps one writer connection and a separate pool of query-only connections.
+//In WAL mode readers see the last committed data and don't wait for the writer
+type T struct {
+	db   *sql.DB // the only connection for writes and reads inside write statements
+	read *sql.DB // connections for plain reads
+}
+
+//New opens (or creates) database file. Migrations applied if not exist
+func New(ctx context.Context, path string) (T, error) {
+	var t T
+	var err error
+	dsn := "file:" + path + "?" + url.Values{"_pragma": {
+		"busy_timeout(5000)",
+		"journal_mode(WAL)",
+		"synchronous(NORMAL)",
+	}}.Encode()
+	t.db, err = sql.Open("sqlite", dsn)
+	if err != nil {
+		return t, err
+	}
+	// single writer connection avoids "database is locked" errors under concurrent writes,
+	// but serializes everything sent through it, so plain reads go to t.read
+	t.db.SetMaxOpenConns(1)
+
+	if err = t.migrateUp(ctx); err != nil {
+		_ = t.db.Close()
+		return t, err
+	}
+
+	// читающие соединения открываются после создания таблиц и включения WAL
+	t.read, err = sql.Open("sqlite", "file:"+path+"?"+url.Values{"_pragma": {
+		"busy_timeout(5000)",
+		"query_only(true)",
+	}}.Encode())
+	if err != nil {
+		_ = t.db.Close()
+		return t, err
+	}
+	return t, nil
+}
+
+//entityColumns are columns of urls table, scanned into db.Entity by scanEntity
+const entityColumns = "deleted, user_id, short_id, long_url, expires_at"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+//scanEntity scans entityColumns of row into e
+func scanEntity(row scanner, e *db.Entity) error {
+	var expiresAt sql.NullInt64
+	err := row.Scan(&e.Deleted, &e.UserID, &e.ShortID, &e.LongURL, &expiresAt)
+	e.ExpiresAt = nil
+	if expiresAt.Valid {
+		t := time.Unix(expiresAt.Int64, 0).UTC()
+		e.ExpiresAt = &t
+	}
+	return err
+}
+
+//unixTime returns expiration time as unix seconds for expires_at column
+func unixTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.Unix()
+}
+
+//noInterrupt hides cancellation of ctx from driver. For every statement with cancelable context
+//modernc.org/sqlite starts goroutine, which interrupts connection, when ctx is done. It isn't waited for,
+//so cancellation right after the statement interrupts idle connection concurrently with its closing.
+//Statements of local database are short, so they are completed instead of being interrupted
+type noInterrupt struct {
+	context.Context
+}
+
+func (noInterrupt) Done() <-chan struct{} {
+	return nil
+}
+
+func (noInterrupt) Err() error {
+	return nil
+}
+
+//Close closes database
+func (t *T) Close() {
+	_ = t.read.Close()
+	_ = t.db.Close()
+}
+
+//uniqueViolation converts unique constraint errors to db.ErrShortIDConflict.
+//Inserts resolve conflicts of long URL by conflict clauses, so only short ID may violate uniqueness
+func uniqueViolation(err error) error {
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE {
+		return db.ErrShortIDConflict
+	}
+	return err
+}
+
+//reapExpired marks expired row of long URL deleted, as reaper does, so it doesn't hold long URL.
+//Row of long URL is unique only among not deleted rows
+const reapExpired = "update urls set deleted = true where long_url = ? and not deleted and expires_at <= ?"
+
+//onLiveConflict is conflict target of not deleted row of the same long URL
+const onLiveConflict = "on conflict (long_url) where not deleted "
+
+//AddEntity adds new row Entity in DB. If live row of long URL already exists, returns db.ErrUniqueViolation.
+//Deleted or expired row of the same long URL is kept under its short ID
+func (t *T) AddEntity(ctx context.Context, e db.Entity) error {
+	ctx = noInterrupt{ctx}
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, reapExpired, e.LongURL, time.Now().Unix()); err != nil {
+		return err
+	}
+	query := "insert into urls (deleted, user_id, short_id, long_url, expires_at) values (?, ?, ?, ?, ?) " + onLiveConflict + "do nothing"
+	res, err := tx.ExecContext(ctx, query, e.Deleted, e.UserID, e.ShortID, e.LongURL, unixTime(e.ExpiresAt))
+	if err != nil {
+		return uniqueViolation(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return db.ErrUniqueViolation
+	}
+	return tx.Commit()
+}
+
+//upsertEntity inserts one row Entity or, if live row of long URL already exists, returns existing row
+const upsertEntity = "insert into urls (deleted, user_id, short_id, long_url, expires_at) values (?, ?, ?, ?, ?) " +
+	onLiveConflict + "do update set long_url = excluded.long_url " +
+	"returning " + entityColumns
+
+//upsertAlias is upsertEntity, which inserts nothing and returns no row, if short ID is already taken.
+//Existing live row of the same long URL is returned, if short ID is free
+const upsertAlias = "insert into urls (deleted, user_id, short_id, long_url, expires_at) " +
+	"select ?1, ?2, ?3, ?4, ?5 where not exists (select 1 from urls where short_id = ?3) " +
+	onLiveConflict + "do update set long_url = excluded.long_url " +
+	"returning " + entityColumns
+
+//AddOrGetEntity adds new row Entity in DB or returns existing live row with the same long URL.
+//Deleted or expired row of the same long URL is kept, new row is added under new short ID.
+//created is false if entity already existed. If short ID is taken, returns db.ErrShortIDConflict
+func (t *T) AddOrGetEntity(ctx context.Context, e db.Entity) (stored db.Entity, created bool, err error) {
+	ctx = noInterrupt{ctx}
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return stored, false, err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, reapExpired, e.LongURL, time.Now().Unix()); err != nil {
+		return stored, false, err
+	}
+	err = scanEntity(tx.QueryRowContext(ctx, upsertEntity, e.Deleted, e.UserID, e.ShortID, e.LongURL, unixTime(e.ExpiresAt)), &stored)
+	if err != nil {
+		return stored, false, uniqueViolation(err)
+	}
+	return stored, stored.ShortID == e.ShortID, tx.Commit()
+}
+
+//SelectByLongURL returns row Entity for known long URL or db.ErrNotFound.
+//Of several rows of long URL, not deleted or the latest one is returned
+func (t *T) SelectByLongURL(ctx context.Context, longURL string) (db.Entity, error) {
+	ctx = noInterrupt{ctx}
+	row := t.read.QueryRowContext(ctx, "select "+entityColumns+" from urls where long_url = ? order by deleted, id desc limit 1", longURL)
+	var e db.Entity
+	err := scanEntity(row, &e)
+	if errors.Is(err, sql.ErrNoRows) {
+		return e, db.ErrNotFound
+	}
+	return e, err
+}
+
+//SelectByShortID returns row Entity for known short ID or db.ErrNotFound
+func (t *T) SelectByShortID(ctx context.Context, shortID string) (db.Entity, error) {
+	ctx = noInterrupt{ctx}
+	row := t.read.QueryRowContext(ctx, "select "+entityColumns+" from urls where short_id = ?", shortID)
+	var e db.Entity
+	err := scanEntity(row, &e)
+	if errors.Is(err, sql.ErrNoRows) {
+		return e, db.ErrNotFound
+	}
+	return e, err
+}
+
+//SelectByUser returns all Entity rows for given userID
+func (t *T) SelectByUser(ctx context.Context, userID string) ([]db.Entity, error) {
+	ctx = noInterrupt{ctx}
+	rows, err := t.read.QueryContext(ctx, "select "+entityColumns+" from urls where user_id = ? order by id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var e db.Entity
+	eArray := make([]db.Entity, 0, 10)
+	for rows.Next() {
+		err = scanEntity(rows, &e)
+		if err != nil {
+			return nil, err
+		}
+		eArray = append(eArray, e)
+	}
+	return eArray, rows.Err()
+}
+
+//AddEntityBatch adds BatchInput by insert-or-get statements in transaction mode.
+//Items with status db.BatchInvalid are skipped. Other items get status db.BatchCreated or db.BatchExists,
+//ShortID of already existing long URL is replaced by stored one. Deleted or expired rows are kept, new rows are added.
+//Item with alias, taken by other row, gets status db.BatchAliasTaken and is not stored.
+//If generated short ID of any new item is taken, nothing is added and db.ErrShortIDConflict returned
+func (t *T) AddEntityBatch(ctx context.Context, userID string, data db.BatchInput) error {
+	ctx = noInterrupt{ctx}
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, upsertEntity)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	aliasStmt, err := tx.PrepareContext(ctx, upsertAlias)
+	if err != nil {
+		return err
+	}
+	defer aliasStmt.Close()
+
+	reapStmt, err := tx.PrepareContext(ctx, reapExpired)
+	if err != nil {
+		return err
+	}
+	defer reapStmt.Close()
+
+	now := time.Now().Unix()
+	for i, v := range data {
+		if v.Status == db.BatchInvalid {
+			continue
+		}
+		if _, err = reapStmt.ExecContext(ctx, v.OriginalURL, now); err != nil {
+			return err
+		}
+		var e db.Entity
+		if v.Alias != "" {
+			err = scanEntity(aliasStmt.QueryRowContext(ctx, v.Deleted, userID, v.ShortID, v.OriginalURL, unixTime(v.ExpiresAt)), &e)
+			if errors.Is(err, sql.ErrNoRows) {
+				// alias is taken, possibly by the same long URL
+				err = tx.QueryRowContext(ctx, "select short_id from urls where long_url = ? and not deleted", v.OriginalURL).Scan(&e.ShortID)
+				if errors.Is(err, sql.ErrNoRows) {
+					data[i].Status = db.BatchAliasTaken
+					continue
+				}
+				if err == nil {
+					data[i].ShortID, data[i].Status = e.ShortID, db.BatchExists
+					continue
+				}
+			}
+		} else {
+			err = scanEntity(stmt.QueryRowContext(ctx, v.Deleted, userID, v.ShortID, v.OriginalURL, unixTime(v.ExpiresAt)), &e)
+		}
+		if err != nil {
+			return uniqueViolation(err)
+		}
+		data[i].Status = db.BatchCreated
+		if e.ShortID != v.ShortID {
+			data[i].ShortID, data[i].Status = e.ShortID, db.BatchExists
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("unable to commit: %w", err)
+	}
+	return nil
+}
+
+//Ping checks database is alive
+func (t *T) Ping(ctx context.Context) error {
+	ctx = noInterrupt{ctx}
+	return t.db.PingContext(ctx)
+}
+
+//SetDeletedBatch deletes several Entities of given user by one statement.
+//Short IDs are passed as one JSON array parameter, so there is no limit of statement variables.
+//Doesn't remove rows, only sets deleted flags = true.
+//Returns short IDs, which belong to user and are deleted now; already deleted ones are not returned
+func (t *T) SetDeletedBatch(ctx context.Context, userID string, shortIDs []string) ([]string, error) {
+	ctx = noInterrupt{ctx}
+	ids, err := json.Marshal(shortIDs)
+	if err != nil {
+		return nil, err
+	}
+	query := "update urls set deleted = true where user_id = ? and short_id in (select value from json_each(?)) and not deleted returning short_id"
+	rows, err := t.db.QueryContext(ctx, query, userID, string(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deleted := make([]string, 0, len(shortIDs))
+	for rows.Next() {
+		var shortID string
+		if err = rows.Scan(&shortID); err != nil {
+			return nil, err
+		}
+		deleted = append(deleted, shortID)
+	}
+	return deleted, rows.Err()
+}
+
+//DeleteExpired sets deleted flag for all not deleted Entities with expiration time not after now.
+//Returns number of deleted Entities
+func (t *T) DeleteExpired(ctx context.Context, now time.Time) (int64, error) {
+	ctx = noInterrupt{ctx}
+	res, err := t.db.ExecContext(ctx, "update urls set deleted = true where not deleted and expires_at <= ?", now.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+//SetDeleted delete one row Entity.
+//Doesn't remove row, only sets deleted flag = true
+func (t *T) SetDeleted(ctx context.Context, item pool.ToDeleteItem) error {
+	ctx = noInterrupt{ctx}
+	query := "update urls set deleted = true where short_id = ? and user_id = ?"
+	_, err := t.db.ExecContext(ctx, query, item.ShortID, item.UserID)
+	return err
+}